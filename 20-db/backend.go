@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Backend is the storage engine behind a key-value store: the LSM tree
+// (KDB) or the paged B+ tree (BPlusTree). Snapshots, transactions, batches
+// and the conditional writes are specific to the LSM backend.
+type Backend interface {
+	Get(key string) (string, bool, error)
+	Put(key, val string) error
+	Delete(key string) error
+	NewIterator(opts IterOptions) Iterator
+	Close() error
+}
+
+var (
+	_ Backend = (*KDB)(nil)
+	_ Backend = (*BPlusTree)(nil)
+)
+
+// BackendKind selects the storage engine opened by openBackend.
+type BackendKind int
+
+const (
+	// BackendLSM is the log-structured merge tree: a WAL and memtable in
+	// front of SSTables. It favours write throughput.
+	BackendLSM BackendKind = iota
+	// BackendPaged is a B+ tree updated in place in a single page file. It
+	// favours point reads and needs no replay on open.
+	BackendPaged
+)
+
+func (k BackendKind) String() string {
+	switch k {
+	case BackendLSM:
+		return "lsm"
+	case BackendPaged:
+		return "paged"
+	}
+	return fmt.Sprintf("BackendKind(%d)", int(k))
+}
+
+// pagedFile is the page file of a paged DB inside its directory.
+const pagedFile = "tree.pages"
+
+// openBackend opens the DB in dir with the engine chosen by opts.Backend.
+func openBackend(dir string, opts Options) (Backend, error) {
+	// Each case checks err itself so a failed open returns a nil Backend,
+	// not one holding a nil pointer.
+	switch opts.Backend {
+	case BackendLSM:
+		db, err := Open(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case BackendPaged:
+		opts = opts.withDefaults()
+		if err := opts.FS.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("create DB directory: %w", err)
+		}
+		t, err := OpenBPlusTree(filepath.Join(dir, pagedFile), opts.Paged)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown backend %v", opts.Backend)
+}
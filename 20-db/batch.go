@@ -0,0 +1,42 @@
+package main
+
+// WriteBatch collects puts and deletes that KDB.Write applies as one unit:
+// they are logged as a single WAL record and land in the memtable together,
+// so after a crash either every operation of the batch is recovered or none
+// is. Operations on the same key apply in the order they were added.
+type WriteBatch struct {
+	ops []WALOperation
+}
+
+// Put adds a write of val under key to the batch.
+func (b *WriteBatch) Put(key, val string) {
+	b.ops = append(b.ops, WALOperation{Operation: opPut, Key: key, Value: val})
+}
+
+// Delete adds a deletion of key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, WALOperation{Operation: opDelete, Key: key})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write atomically applies every operation in batch. An empty batch is a
+// no-op.
+func (db *KDB) Write(batch *WriteBatch) error {
+	if batch == nil || len(batch.ops) == 0 {
+		return nil
+	}
+	// apply inserts the whole batch under one hold of db.mu, so readers see
+	// all of it or none of it, and only flushes afterwards, so a batch never
+	// straddles two SSTables.
+	ops := append([]WALOperation(nil), batch.ops...)
+	return db.apply(WALOperation{Operation: opBatch, Batch: ops}, nil)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync/atomic"
+)
+
+// defaultBloomBitsPerKey gives roughly a 1% false-positive rate.
+const defaultBloomBitsPerKey = 10
+
+// bloomFilter is a standard Bloom filter using double hashing: the i-th
+// probe is h1 + i*h2, with h1 and h2 taken from the two halves of a 64-bit
+// FNV-1a hash of the key.
+type bloomFilter struct {
+	bits []byte
+	k    int // number of probes per key
+}
+
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+// newBloomFilter sizes a filter for n keys at bitsPerKey bits each and adds
+// the given key hashes.
+func newBloomFilter(hashes [][2]uint32, bitsPerKey int) *bloomFilter {
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	// k = ln(2) * bits/key minimises the false-positive rate.
+	k := int(math.Round(float64(bitsPerKey) * math.Ln2))
+	k = max(1, min(k, 30))
+
+	f := &bloomFilter{bits: make([]byte, (nbits+7)/8), k: k}
+	for _, h := range hashes {
+		f.add(h[0], h[1])
+	}
+	return f
+}
+
+func (f *bloomFilter) add(h1, h2 uint32) {
+	nbits := uint32(len(f.bits) * 8)
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint32(i)*h2) % nbits
+		f.bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+// mayContain reports false only if key was definitely never added.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	nbits := uint32(len(f.bits) * 8)
+	for i := 0; i < f.k; i++ {
+		pos := (h1 + uint32(i)*h2) % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encode serialises the filter as one byte of k followed by the bit array.
+func (f *bloomFilter) encode() []byte {
+	return append([]byte{byte(f.k)}, f.bits...)
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 2 || data[0] == 0 {
+		return nil, fmt.Errorf("%w: bad bloom filter", ErrCorruptSSTable)
+	}
+	return &bloomFilter{k: int(data[0]), bits: data[1:]}, nil
+}
+
+// FilterStats counts how SSTable Bloom filters performed on lookups.
+type FilterStats struct {
+	Checks         int64 // lookups that consulted a filter
+	Negatives      int64 // lookups the filter answered without reading a block
+	FalsePositives int64 // lookups the filter let through for a missing key
+}
+
+// HitRate is the fraction of filter checks that skipped the data blocks.
+func (s FilterStats) HitRate() float64 {
+	if s.Checks == 0 {
+		return 0
+	}
+	return float64(s.Negatives) / float64(s.Checks)
+}
+
+// FalsePositiveRate is the fraction of lookups for absent keys that the
+// filter failed to reject.
+func (s FilterStats) FalsePositiveRate() float64 {
+	absent := s.Negatives + s.FalsePositives
+	if absent == 0 {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(absent)
+}
+
+func (s FilterStats) add(o FilterStats) FilterStats {
+	return FilterStats{
+		Checks:         s.Checks + o.Checks,
+		Negatives:      s.Negatives + o.Negatives,
+		FalsePositives: s.FalsePositives + o.FalsePositives,
+	}
+}
+
+// filterCounters is the lock-free form of FilterStats kept per table.
+type filterCounters struct {
+	checks, negatives, falsePositives atomic.Int64
+}
+
+func (c *filterCounters) snapshot() FilterStats {
+	return FilterStats{
+		Checks:         c.checks.Load(),
+		Negatives:      c.negatives.Load(),
+		FalsePositives: c.falsePositives.Load(),
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golangdsa/20-db/bufferpool"
+)
+
+// Defaults for PagedOptions.
+const (
+	defaultPageSize   = 4 << 10
+	defaultFanout     = 64
+	defaultCachePages = 256
+)
+
+// ErrEntryTooLarge is returned when a key/value pair is too big for a page
+// of the paged backend.
+var ErrEntryTooLarge = errors.New("kdb: entry too large for page")
+
+// PagedOptions tunes the paged B+ tree backend. PageSize and Fanout are
+// fixed when the file is created; reopening an existing file uses what it
+// was created with.
+type PagedOptions struct {
+	// PageSize is the size of every page in bytes.
+	PageSize int
+	// Fanout is the maximum number of keys per node. Nodes also split
+	// early when their entries no longer fit in a page.
+	Fanout int
+	// CachePages is the number of pages the buffer pool keeps in memory,
+	// which bounds the tree's footprint whatever its size on disk.
+	CachePages int
+	// FS is the file system the page file lives on. Nil means OSFS, or
+	// Options.FS when the tree is a DB's backend.
+	FS FS
+}
+
+func (o PagedOptions) withDefaults() PagedOptions {
+	if o.PageSize <= 0 {
+		o.PageSize = defaultPageSize
+	}
+	o.PageSize = max(o.PageSize, minPageSize)
+	if o.Fanout < 3 {
+		o.Fanout = defaultFanout
+	}
+	if o.CachePages <= 0 {
+		o.CachePages = defaultCachePages
+	}
+	if o.FS == nil {
+		o.FS = OSFS
+	}
+	return o
+}
+
+// BPlusTree is a disk-resident B+ tree over a page file. Values live only
+// in the leaves, which are chained left to right through sibling links so
+// range scans never go back up the tree. Unlike the memtable it does not
+// need to fit in memory or be rebuilt from a log on start.
+//
+// Pages are read and modified through a bounded buffer pool, which writes
+// them back in place when it evicts them; Sync and Close write back the rest
+// and sync the file. There is no log in front of it, so a crash between
+// syncs can lose or tear recent writes.
+type BPlusTree struct {
+	mu    sync.RWMutex
+	pager *pager
+}
+
+// bpNode is the decoded form of a leaf or internal page. An internal node
+// has len(keys)+1 children; child i holds the keys k with
+// keys[i-1] <= k < keys[i].
+type bpNode struct {
+	id   uint32
+	leaf bool
+	keys []string
+	vals []string // leaves only
+	kids []uint32 // internal nodes only
+	next uint32   // right sibling of a leaf, 0 for the last one
+}
+
+// OpenBPlusTree opens or creates the paged B+ tree stored at path.
+func OpenBPlusTree(path string, opts PagedOptions) (*BPlusTree, error) {
+	opts = opts.withDefaults()
+	p, err := openPager(opts.FS, path, opts.PageSize, opts.Fanout, opts.CachePages)
+	if err != nil {
+		return nil, err
+	}
+	t := &BPlusTree{pager: p}
+	if p.root == 0 {
+		// A fresh file: start with an empty leaf as the root.
+		root := &bpNode{leaf: true}
+		if root.id, err = p.allocate(); err == nil {
+			if err = t.writeNode(root); err == nil {
+				p.root = root.id
+				err = p.writeHeader()
+			}
+		}
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Get returns the value stored under key, or the error of reading a page
+// on the way to its leaf.
+func (t *BPlusTree) Get(key string) (string, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n, err := t.findLeaf(key)
+	if err != nil {
+		return "", false, err
+	}
+	i := sort.SearchStrings(n.keys, key)
+	if i == len(n.keys) || n.keys[i] != key {
+		return "", false, nil
+	}
+	return n.vals[i], true, nil
+}
+
+// Put stores val under key, overwriting any previous value.
+func (t *BPlusTree) Put(key, val string) error {
+	if len(key)+len(val) > t.maxEntrySize() {
+		return fmt.Errorf("%w: %d bytes", ErrEntryTooLarge, len(key)+len(val))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	root, err := t.readNode(t.pager.root)
+	if err != nil {
+		return err
+	}
+	sep, right, err := t.insert(root, key, val)
+	if err != nil {
+		return err
+	}
+	if right != nil {
+		newRoot := &bpNode{keys: []string{sep}, kids: []uint32{root.id, right.id}}
+		if newRoot.id, err = t.pager.allocate(); err != nil {
+			return err
+		}
+		if err := t.writeNode(newRoot); err != nil {
+			return err
+		}
+		t.pager.root = newRoot.id
+	}
+	return t.pager.writeHeader()
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (t *BPlusTree) Delete(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	root, err := t.readNode(t.pager.root)
+	if err != nil {
+		return err
+	}
+	if _, err := t.remove(root, key); err != nil {
+		return err
+	}
+	// An internal root left with a single child hands the root role down.
+	for !root.leaf && len(root.keys) == 0 {
+		old := root.id
+		if root, err = t.readNode(root.kids[0]); err != nil {
+			return err
+		}
+		t.pager.root = root.id
+		if err := t.pager.free(old); err != nil {
+			return err
+		}
+	}
+	return t.pager.writeHeader()
+}
+
+// NewIterator returns an iterator over the keys within opts. It finds the
+// leaf holding opts.Start and then follows sibling links.
+func (t *BPlusTree) NewIterator(opts IterOptions) Iterator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var entries []kvEntry
+	n, err := t.findLeaf(opts.Start)
+	for err == nil {
+		for i, key := range n.keys {
+			if opts.End != "" && key >= opts.End {
+				n.next = 0
+				break
+			}
+			if opts.contains(key) {
+				val := n.vals[i]
+				entries = append(entries, kvEntry{key: key, val: &val})
+			}
+		}
+		if n.next == 0 {
+			break
+		}
+		n, err = t.readNode(n.next)
+	}
+
+	src := newSliceIterator(entries, opts.Reverse)
+	src.readErr = err
+	return newMergingIterator([]recordIterator{src}, opts.Reverse, wallClock(), nil)
+}
+
+// Range returns a forward iterator over keys in [start, end).
+func (t *BPlusTree) Range(start, end string) Iterator {
+	return t.NewIterator(IterOptions{Start: start, End: end})
+}
+
+// Prefix returns a forward iterator over keys starting with p.
+func (t *BPlusTree) Prefix(p string) Iterator {
+	return t.NewIterator(IterOptions{Start: p, End: prefixEnd(p)})
+}
+
+// CacheStats reports how the buffer pool has served page reads.
+func (t *BPlusTree) CacheStats() bufferpool.Stats {
+	return t.pager.pool.Stats()
+}
+
+// Sync flushes written pages to stable storage.
+func (t *BPlusTree) Sync() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pager.sync()
+}
+
+// Close syncs and closes the page file.
+func (t *BPlusTree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.pager.sync(); err != nil {
+		t.pager.close()
+		return err
+	}
+	return t.pager.close()
+}
+
+// findLeaf descends from the root to the leaf that holds or would hold key.
+func (t *BPlusTree) findLeaf(key string) (*bpNode, error) {
+	n, err := t.readNode(t.pager.root)
+	for err == nil && !n.leaf {
+		n, err = t.readNode(n.kids[childIndex(n, key)])
+	}
+	return n, err
+}
+
+// childIndex returns the child of internal node n that covers key.
+func childIndex(n *bpNode, key string) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+}
+
+// insert adds key to the subtree rooted at n. If n had to split, it returns
+// the new right sibling and the separator key the parent must add.
+func (t *BPlusTree) insert(n *bpNode, key, val string) (string, *bpNode, error) {
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			n.vals[i] = val
+		} else {
+			n.keys = insertAt(n.keys, i, key)
+			n.vals = insertAt(n.vals, i, val)
+		}
+		return t.splitIfNeeded(n)
+	}
+
+	i := childIndex(n, key)
+	child, err := t.readNode(n.kids[i])
+	if err != nil {
+		return "", nil, err
+	}
+	sep, right, err := t.insert(child, key, val)
+	if err != nil || right == nil {
+		return "", nil, err
+	}
+	n.keys = insertAt(n.keys, i, sep)
+	n.kids = insertAt(n.kids, i+1, right.id)
+	return t.splitIfNeeded(n)
+}
+
+// splitIfNeeded writes n back, first splitting it in two if it holds more
+// than fanout keys or no longer fits in a page.
+func (t *BPlusTree) splitIfNeeded(n *bpNode) (string, *bpNode, error) {
+	if len(n.keys) <= t.pager.fanout && t.fits(n) {
+		return "", nil, t.writeNode(n)
+	}
+
+	mid := t.splitPoint(n)
+	right := &bpNode{leaf: n.leaf}
+	var sep string
+	if n.leaf {
+		// Leaves keep every key; the separator is a copy of the right
+		// half's first key.
+		right.keys = append(right.keys, n.keys[mid:]...)
+		right.vals = append(right.vals, n.vals[mid:]...)
+		n.keys, n.vals = n.keys[:mid], n.vals[:mid]
+		sep = right.keys[0]
+	} else {
+		// Internal nodes move the middle key up to the parent.
+		sep = n.keys[mid]
+		right.keys = append(right.keys, n.keys[mid+1:]...)
+		right.kids = append(right.kids, n.kids[mid+1:]...)
+		n.keys, n.kids = n.keys[:mid], n.kids[:mid+1]
+	}
+
+	var err error
+	if right.id, err = t.pager.allocate(); err != nil {
+		return "", nil, err
+	}
+	if n.leaf {
+		right.next, n.next = n.next, right.id
+	}
+	if err := t.writeNode(right); err != nil {
+		return "", nil, err
+	}
+	if err := t.writeNode(n); err != nil {
+		return "", nil, err
+	}
+	return sep, right, nil
+}
+
+// splitPoint picks the index to split n at so both halves carry about the
+// same number of bytes, which for entries of similar size is the middle.
+func (t *BPlusTree) splitPoint(n *bpNode) int {
+	total := 0
+	for i := range n.keys {
+		total += t.entrySize(n, i)
+	}
+	size := 0
+	for i := range n.keys {
+		size += t.entrySize(n, i)
+		if size >= total/2 {
+			// Keep at least one key on each side (and, for internal
+			// nodes, one on each side of the promoted key).
+			lo, hi := 1, len(n.keys)-1
+			if !n.leaf {
+				hi = len(n.keys) - 2
+			}
+			return min(max(i+1, lo), hi)
+		}
+	}
+	return len(n.keys) / 2
+}
+
+// remove deletes key from the subtree rooted at n and reports whether n is
+// now underfull. The caller rebalances underfull children.
+func (t *BPlusTree) remove(n *bpNode, key string) (bool, error) {
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return false, nil
+		}
+		n.keys = removeAt(n.keys, i)
+		n.vals = removeAt(n.vals, i)
+		return t.underfull(n), t.writeNode(n)
+	}
+
+	i := childIndex(n, key)
+	child, err := t.readNode(n.kids[i])
+	if err != nil {
+		return false, err
+	}
+	under, err := t.remove(child, key)
+	if err != nil || !under {
+		return false, err
+	}
+	if err := t.rebalance(n, i, child); err != nil {
+		return false, err
+	}
+	return t.underfull(n), nil
+}
+
+// rebalance fixes the underfull child i of n by merging it with a sibling,
+// or else by borrowing one entry from it. Entries vary in size, so neither
+// may be possible; the child is then left as it is, which only costs
+// space. n is written back if it changed.
+func (t *BPlusTree) rebalance(n *bpNode, i int, child *bpNode) error {
+	// Always work on an adjacent (left, right) pair under separator s.
+	s := i
+	if i == len(n.kids)-1 {
+		s = i - 1
+	}
+	if s < 0 {
+		return nil
+	}
+	left, right := child, (*bpNode)(nil)
+	var err error
+	if s == i {
+		right, err = t.readNode(n.kids[i+1])
+	} else {
+		left, right = nil, child
+		left, err = t.readNode(n.kids[s])
+	}
+	if err != nil {
+		return err
+	}
+
+	if merged := t.merge(left, right, n.keys[s]); merged != nil {
+		if err := t.writeNode(merged); err != nil {
+			return err
+		}
+		if err := t.pager.free(right.id); err != nil {
+			return err
+		}
+		n.keys = removeAt(n.keys, s)
+		n.kids = removeAt(n.kids, s+1)
+		return t.writeNode(n)
+	}
+
+	if !t.borrow(left, right, n, s, left == child) {
+		return nil
+	}
+	if err := t.writeNode(left); err != nil {
+		return err
+	}
+	if err := t.writeNode(right); err != nil {
+		return err
+	}
+	return t.writeNode(n)
+}
+
+// merge returns left with right folded into it, or nil if the result would
+// not fit in one page.
+func (t *BPlusTree) merge(left, right *bpNode, sep string) *bpNode {
+	m := &bpNode{id: left.id, leaf: left.leaf}
+	m.keys = append(append([]string{}, left.keys...), right.keys...)
+	if left.leaf {
+		m.vals = append(append([]string{}, left.vals...), right.vals...)
+		m.next = right.next
+	} else {
+		// The separator comes back down between the two halves.
+		m.keys = insertAt(m.keys, len(left.keys), sep)
+		m.kids = append(append([]uint32{}, left.kids...), right.kids...)
+	}
+	if len(m.keys) > t.pager.fanout || !t.fits(m) {
+		return nil
+	}
+	return m
+}
+
+// borrow moves one entry into the underfull node of the pair from its
+// sibling, updating separator s of parent. It reports whether it did.
+func (t *BPlusTree) borrow(left, right, parent *bpNode, s int, intoLeft bool) bool {
+	from, into := left, right
+	if intoLeft {
+		from, into = right, left
+	}
+	if t.underfull(from) || len(from.keys) < 2 {
+		return false
+	}
+	saved := [2]bpNode{*left, *right}
+	savedSep := parent.keys[s]
+
+	switch {
+	case left.leaf && intoLeft:
+		left.keys, left.vals = append(left.keys, right.keys[0]), append(left.vals, right.vals[0])
+		right.keys, right.vals = right.keys[1:], right.vals[1:]
+		parent.keys[s] = right.keys[0]
+	case left.leaf:
+		last := len(left.keys) - 1
+		right.keys, right.vals = insertAt(right.keys, 0, left.keys[last]), insertAt(right.vals, 0, left.vals[last])
+		left.keys, left.vals = left.keys[:last], left.vals[:last]
+		parent.keys[s] = right.keys[0]
+	case intoLeft:
+		left.keys, left.kids = append(left.keys, parent.keys[s]), append(left.kids, right.kids[0])
+		parent.keys[s] = right.keys[0]
+		right.keys, right.kids = right.keys[1:], right.kids[1:]
+	default:
+		last := len(left.keys) - 1
+		right.keys, right.kids = insertAt(right.keys, 0, parent.keys[s]), insertAt(right.kids, 0, left.kids[last+1])
+		parent.keys[s] = left.keys[last]
+		left.keys, left.kids = left.keys[:last], left.kids[:last+1]
+	}
+
+	if !t.fits(into) || !t.fits(parent) {
+		*left, *right = saved[0], saved[1]
+		parent.keys[s] = savedSep
+		return false
+	}
+	return true
+}
+
+// underfull reports whether n holds less than half the fanout.
+func (t *BPlusTree) underfull(n *bpNode) bool {
+	return len(n.keys) < t.pager.fanout/2
+}
+
+// maxEntrySize bounds a key/value pair so that a split always produces two
+// halves that fit in a page.
+func (t *BPlusTree) maxEntrySize() int {
+	return t.pager.pageSize/4 - 16
+}
+
+// Node pages are laid out, after the common page header, as
+//
+//	leaf:     count:2 | next:4 | count × (uvarint keyLen | key | uvarint valLen | value)
+//	internal: count:2 | child0:4 | count × (uvarint keyLen | key | child:4)
+const bpNodeHeaderSize = pageHeaderSize + 2 + 4
+
+// entrySize is the encoded size of entry i of n.
+func (t *BPlusTree) entrySize(n *bpNode, i int) int {
+	size := uvarintLen(len(n.keys[i])) + len(n.keys[i])
+	if n.leaf {
+		return size + uvarintLen(len(n.vals[i])) + len(n.vals[i])
+	}
+	return size + 4
+}
+
+// fits reports whether n encodes into a single page.
+func (t *BPlusTree) fits(n *bpNode) bool {
+	size := bpNodeHeaderSize
+	for i := range n.keys {
+		size += t.entrySize(n, i)
+	}
+	return size <= t.pager.pageSize
+}
+
+func (t *BPlusTree) writeNode(n *bpNode) error {
+	page := make([]byte, bpNodeHeaderSize, t.pager.pageSize)
+	binary.LittleEndian.PutUint16(page[pageHeaderSize:], uint16(len(n.keys)))
+	if n.leaf {
+		page[4] = pageTypeLeaf
+		binary.LittleEndian.PutUint32(page[pageHeaderSize+2:], n.next)
+		for i, key := range n.keys {
+			page = appendBytes(page, []byte(key))
+			page = appendBytes(page, []byte(n.vals[i]))
+		}
+	} else {
+		page[4] = pageTypeInternal
+		binary.LittleEndian.PutUint32(page[pageHeaderSize+2:], n.kids[0])
+		for i, key := range n.keys {
+			page = appendBytes(page, []byte(key))
+			page = binary.LittleEndian.AppendUint32(page, n.kids[i+1])
+		}
+	}
+	if len(page) > t.pager.pageSize {
+		return fmt.Errorf("%w: node %d overflows its page", ErrCorruptPage, n.id)
+	}
+	return t.pager.write(n.id, page[:t.pager.pageSize])
+}
+
+func (t *BPlusTree) readNode(id uint32) (*bpNode, error) {
+	page, err := t.pager.read(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(id, page)
+}
+
+// decodeNode parses a leaf or internal page.
+func decodeNode(id uint32, page []byte) (*bpNode, error) {
+	n := &bpNode{id: id}
+	switch page[4] {
+	case pageTypeLeaf:
+		n.leaf = true
+	case pageTypeInternal:
+	default:
+		return nil, fmt.Errorf("%w: page %d has type %d, want a tree node", ErrCorruptPage, id, page[4])
+	}
+	count := int(binary.LittleEndian.Uint16(page[pageHeaderSize:]))
+	link := binary.LittleEndian.Uint32(page[pageHeaderSize+2:])
+	if n.leaf {
+		n.next = link
+	} else {
+		n.kids = append(n.kids, link)
+	}
+
+	r := &byteReader{data: page[bpNodeHeaderSize:]}
+	for i := 0; i < count && r.err == nil; i++ {
+		n.keys = append(n.keys, string(r.bytes()))
+		if n.leaf {
+			n.vals = append(n.vals, string(r.bytes()))
+			continue
+		}
+		if len(r.data) < 4 {
+			r.err = errors.New("truncated child pointer")
+			break
+		}
+		n.kids = append(n.kids, binary.LittleEndian.Uint32(r.data))
+		r.data = r.data[4:]
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: page %d: %v", ErrCorruptPage, id, r.err)
+	}
+	return n, nil
+}
+
+func insertAt[T any](s []T, i int, v T) []T {
+	s = append(s, v)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
+
+func removeAt[T any](s []T, i int) []T {
+	return append(s[:i], s[i+1:]...)
+}
+
+func uvarintLen(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// TestBPlusTreeLargerThanItsCache runs a tree of several hundred pages
+// through 8 frames of 512 bytes, then checks every key after a reopen.
+func TestBPlusTreeLargerThanItsCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pressure.pages")
+	opts := PagedOptions{PageSize: 512, Fanout: 16, CachePages: 8}
+	tree, err := OpenBPlusTree(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := make(map[string]string)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", rng.Intn(5000))
+		if rng.Intn(4) == 0 {
+			err = tree.Delete(key)
+			delete(model, key)
+		} else {
+			val := fmt.Sprintf("%s@%d", key, i)
+			err = tree.Put(key, val)
+			model[key] = val
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := tree.CacheStats()
+	if n := tree.pager.pool.Pinned(); n != 0 {
+		t.Fatalf("%d pages left pinned", n)
+	}
+	if stats.Evictions == 0 {
+		t.Fatalf("no evictions with %d pages in %d frames", tree.pager.pageCount, opts.CachePages)
+	}
+	pages := tree.pager.pageCount
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = OpenBPlusTree(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for key, want := range model {
+		got, ok, err := tree.Get(key)
+		if err != nil {
+			t.Fatalf("%s after reopen: %v", key, err)
+		}
+		if !ok || got != want {
+			t.Fatalf("%s: got %q, %v after reopen, want %q", key, got, ok, want)
+		}
+	}
+	n := 0
+	it := tree.NewIterator(IterOptions{})
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(model) {
+		t.Fatalf("scan found %d keys, want %d", n, len(model))
+	}
+	t.Logf("%d pages through %d frames: %.0f%% hits, %d evictions, %d write-backs",
+		pages, opts.CachePages, 100*stats.HitRate(), stats.Evictions, stats.WriteBacks)
+}
+
+// TestPagedBackendOnFaultFS runs the paged backend on a FaultFS, so every
+// file it creates goes through the FS, and checks that what Close made
+// durable survives a crash.
+func TestPagedBackendOnFaultFS(t *testing.T) {
+	fs := NewFaultFS(1)
+	opts := Options{Backend: BackendPaged, FS: fs, Paged: PagedOptions{PageSize: 512, CachePages: 8}}
+	db, err := openBackend("/kdb/paged", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Put(fmt.Sprintf("key%03d", i), fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.FS = fs.Crash()
+	db, err = openBackend("/kdb/paged", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if got, ok, err := db.Get(key); err != nil || !ok || got != fmt.Sprint(i) {
+			t.Fatalf("%s after crash: %q, %v, %v", key, got, ok, err)
+		}
+	}
+}
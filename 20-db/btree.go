@@ -3,31 +3,70 @@ package main
 import "sort"
 
 // 4-way search / m=4 (max 3 keys, max 4 children)
+// Keys are the original strings and are ordered lexicographically (bytewise).
+// Values are version chains rather than plain strings, so snapshots can
+// keep reading a key while newer writes land on top of it.
 
 type Node struct {
 	cp1  *Node
-	key1 int
-	rp1  *string
+	key1 string
+	rp1  *version
 	cp2  *Node
-	key2 int
-	rp2  *string
+	key2 string
+	rp2  *version
 	cp3  *Node
-	key3 int
-	rp3  *string
+	key3 string
+	rp3  *version
 	cp4  *Node
 	size int
 }
 
+// version is one value of a key, tagged with the sequence number of the
+// write that produced it. older points to the previous value, if any
+// snapshot may still need it. A nil val is a tombstone.
+type version struct {
+	seq     int64
+	val     *string
+	expires int64 // Unix nanoseconds after which val reads as absent, 0 for never
+	older   *version
+}
+
+// at returns the newest version visible at seq, or nil if the key did not
+// exist yet.
+func (v *version) at(seq int64) *version {
+	for v != nil && v.seq > seq {
+		v = v.older
+	}
+	return v
+}
+
+// prune drops the versions below v that no snapshot at or after oldest can
+// see: once a version is visible at oldest, everything older is shadowed.
+// It returns the number of versions dropped.
+func (v *version) prune(oldest int64) int {
+	for ; v != nil; v = v.older {
+		if v.seq <= oldest {
+			n := 0
+			for o := v.older; o != nil; o = o.older {
+				n++
+			}
+			v.older = nil
+			return n
+		}
+	}
+	return 0
+}
+
 // splitResult holds the result of a node split.
 type splitResult struct {
 	promoted    bool
-	promotedKey int
-	promotedVal *string
+	promotedKey string
+	promotedVal *version
 	newRight    *Node
 }
 
 // insert adds a key-value pair into the B-tree.
-func (db *KDB) insert(key int, val *string) {
+func (db *KDB) insert(key string, val *version) {
 	if db.head == nil {
 		db.head = &Node{key1: key, rp1: val, size: 1}
 		db.Size++
@@ -47,7 +86,7 @@ func (db *KDB) insert(key int, val *string) {
 	}
 }
 
-func (db *KDB) insertKeyIntoNode(node *Node, key int, val *string) {
+func (db *KDB) insertKeyIntoNode(node *Node, key string, val *version) {
 	if node.size == 0 {
 		node.key1, node.rp1, node.size = key, val, 1
 		return
@@ -81,7 +120,7 @@ func (db *KDB) isLeaf(node *Node) bool {
 	return node.cp1 == nil && node.cp2 == nil && node.cp3 == nil && node.cp4 == nil
 }
 
-func (db *KDB) insertKey(node *Node, key int, val *string) splitResult {
+func (db *KDB) insertKey(node *Node, key string, val *version) splitResult {
 	if db.isLeaf(node) {
 		if node.size < 3 {
 			db.insertKeyIntoNode(node, key, val)
@@ -123,7 +162,7 @@ func (db *KDB) insertKey(node *Node, key int, val *string) splitResult {
 	return db.splitNode(node, res.promotedKey, res.promotedVal, res.newRight, &childIdx)
 }
 
-func (db *KDB) insertPromotedKey(node *Node, key int, val *string, newRight *Node, afterChildIdx int) {
+func (db *KDB) insertPromotedKey(node *Node, key string, val *version, newRight *Node, afterChildIdx int) {
 	if node.size == 1 {
 		if afterChildIdx == 0 {
 			node.key2, node.rp2 = node.key1, node.rp1
@@ -158,18 +197,18 @@ func (db *KDB) insertPromotedKey(node *Node, key int, val *string, newRight *Nod
 	node.size = 3
 }
 
-func (db *KDB) splitNode(node *Node, newKey int, newVal *string, newChild *Node, afterChildIdx *int) splitResult {
+func (db *KDB) splitNode(node *Node, newKey string, newVal *version, newChild *Node, afterChildIdx *int) splitResult {
 	type kv struct {
-		k int
-		v *string
+		k string
+		v *version
 	}
 	items := []kv{{node.key1, node.rp1}, {node.key2, node.rp2}, {node.key3, node.rp3}, {newKey, newVal}}
 	sort.Slice(items, func(i, j int) bool { return items[i].k < items[j].k })
 
 	// left keeps items[0]
 	node.key1, node.rp1 = items[0].k, items[0].v
-	node.key2, node.rp2 = 0, nil
-	node.key3, node.rp3 = 0, nil
+	node.key2, node.rp2 = "", nil
+	node.key3, node.rp3 = "", nil
 	node.size = 1
 
 	sibling := &Node{key1: items[2].k, rp1: items[2].v, key2: items[3].k, rp2: items[3].v, size: 2}
@@ -188,3 +227,219 @@ func (db *KDB) splitNode(node *Node, newKey int, newVal *string, newChild *Node,
 
 	return splitResult{promoted: true, promotedKey: items[1].k, promotedVal: items[1].v, newRight: sibling}
 }
+
+// valueSlot returns a pointer to the version chain of key, or nil if the key
+// is not in the tree. It lets callers push new versions in place.
+func (db *KDB) valueSlot(key string) **version {
+	return db.slotIn(db.head, key)
+}
+
+// slotIn is valueSlot for the tree rooted at node.
+func (db *KDB) slotIn(node *Node, key string) **version {
+	for node != nil {
+		if node.size >= 1 && node.key1 == key {
+			return &node.rp1
+		}
+		if node.size >= 2 && node.key2 == key {
+			return &node.rp2
+		}
+		if node.size >= 3 && node.key3 == key {
+			return &node.rp3
+		}
+
+		if key < node.key1 {
+			node = node.cp1
+		} else if node.size == 1 || key < node.key2 {
+			node = node.cp2
+		} else if node.size == 2 || key < node.key3 {
+			node = node.cp3
+		} else {
+			node = node.cp4
+		}
+	}
+	return nil
+}
+
+// unpackNode copies a node's keys, values and children into slices so the
+// removal code can shuffle them around without caring about field names.
+// Leaves return a nil children slice.
+func (db *KDB) unpackNode(node *Node) ([]string, []*version, []*Node) {
+	keys := []string{node.key1, node.key2, node.key3}[:node.size]
+	vals := []*version{node.rp1, node.rp2, node.rp3}[:node.size]
+	if db.isLeaf(node) {
+		return keys, vals, nil
+	}
+	kids := []*Node{node.cp1, node.cp2, node.cp3, node.cp4}[:node.size+1]
+	return keys, vals, kids
+}
+
+// packNode writes slices produced by unpackNode back into the node's fixed
+// slots, clearing any slot that is no longer used.
+func (db *KDB) packNode(node *Node, keys []string, vals []*version, kids []*Node) {
+	*node = Node{size: len(keys)}
+	slotKeys := []*string{&node.key1, &node.key2, &node.key3}
+	slotVals := []**version{&node.rp1, &node.rp2, &node.rp3}
+	slotKids := []**Node{&node.cp1, &node.cp2, &node.cp3, &node.cp4}
+	for i := range keys {
+		*slotKeys[i], *slotVals[i] = keys[i], vals[i]
+	}
+	for i := range kids {
+		*slotKids[i] = kids[i]
+	}
+}
+
+// remove deletes key from the B-tree, borrowing from or merging with
+// siblings so that every non-root node keeps at least one key.
+func (db *KDB) remove(key string) bool {
+	if db.head == nil {
+		return false
+	}
+
+	removed := db.removeKey(db.head, key)
+	if db.head.size == 0 {
+		if db.isLeaf(db.head) {
+			db.head = nil
+		} else {
+			db.head = db.head.cp1
+		}
+	}
+	if removed {
+		db.Size--
+	}
+	return removed
+}
+
+// removeKey removes key from the subtree rooted at node. The caller
+// guarantees node has at least two keys (or is the root), so a key can
+// always be taken out of it without underflow.
+func (db *KDB) removeKey(node *Node, key string) bool {
+	keys, vals, kids := db.unpackNode(node)
+	i := 0
+	for i < len(keys) && keys[i] < key {
+		i++
+	}
+
+	if i < len(keys) && keys[i] == key {
+		if kids == nil {
+			keys = append(keys[:i], keys[i+1:]...)
+			vals = append(vals[:i], vals[i+1:]...)
+			db.packNode(node, keys, vals, nil)
+			return true
+		}
+
+		left, right := kids[i], kids[i+1]
+		switch {
+		case left.size >= 2:
+			// Replace with the in-order predecessor, then remove it below.
+			pk, pv := db.maxEntry(left)
+			keys[i], vals[i] = pk, pv
+			db.packNode(node, keys, vals, kids)
+			return db.removeKey(left, pk)
+		case right.size >= 2:
+			// Replace with the in-order successor, then remove it below.
+			sk, sv := db.minEntry(right)
+			keys[i], vals[i] = sk, sv
+			db.packNode(node, keys, vals, kids)
+			return db.removeKey(right, sk)
+		default:
+			db.mergeChildren(node, i)
+			return db.removeKey(left, key)
+		}
+	}
+
+	if kids == nil {
+		return false
+	}
+	if kids[i].size < 2 {
+		i = db.fillChild(node, i)
+	}
+	_, _, kids = db.unpackNode(node)
+	return db.removeKey(kids[i], key)
+}
+
+// fillChild makes sure the i-th child of node has at least two keys before
+// we descend into it, either by borrowing from a sibling or by merging.
+// It returns the index of the child that now covers the original range.
+func (db *KDB) fillChild(node *Node, i int) int {
+	keys, vals, kids := db.unpackNode(node)
+	child := kids[i]
+	ck, cv, cc := db.unpackNode(child)
+
+	if i > 0 && kids[i-1].size >= 2 {
+		// Borrow from the left sibling through the separator key.
+		lk, lv, lc := db.unpackNode(kids[i-1])
+		ck = append([]string{keys[i-1]}, ck...)
+		cv = append([]*version{vals[i-1]}, cv...)
+		if lc != nil {
+			cc = append([]*Node{lc[len(lc)-1]}, cc...)
+			lc = lc[:len(lc)-1]
+		}
+		keys[i-1], vals[i-1] = lk[len(lk)-1], lv[len(lv)-1]
+		db.packNode(kids[i-1], lk[:len(lk)-1], lv[:len(lv)-1], lc)
+		db.packNode(child, ck, cv, cc)
+		db.packNode(node, keys, vals, kids)
+		return i
+	}
+
+	if i < len(kids)-1 && kids[i+1].size >= 2 {
+		// Borrow from the right sibling through the separator key.
+		rk, rv, rc := db.unpackNode(kids[i+1])
+		ck = append(ck, keys[i])
+		cv = append(cv, vals[i])
+		if rc != nil {
+			cc = append(cc, rc[0])
+			rc = rc[1:]
+		}
+		keys[i], vals[i] = rk[0], rv[0]
+		db.packNode(kids[i+1], rk[1:], rv[1:], rc)
+		db.packNode(child, ck, cv, cc)
+		db.packNode(node, keys, vals, kids)
+		return i
+	}
+
+	if i < len(kids)-1 {
+		db.mergeChildren(node, i)
+		return i
+	}
+	db.mergeChildren(node, i-1)
+	return i - 1
+}
+
+// mergeChildren folds child i+1 and the separator key i into child i.
+func (db *KDB) mergeChildren(node *Node, i int) {
+	keys, vals, kids := db.unpackNode(node)
+	lk, lv, lc := db.unpackNode(kids[i])
+	rk, rv, rc := db.unpackNode(kids[i+1])
+
+	lk = append(append(lk, keys[i]), rk...)
+	lv = append(append(lv, vals[i]), rv...)
+	if lc != nil || rc != nil {
+		lc = append(lc, rc...)
+	}
+	db.packNode(kids[i], lk, lv, lc)
+
+	keys = append(keys[:i], keys[i+1:]...)
+	vals = append(vals[:i], vals[i+1:]...)
+	kids = append(kids[:i+1], kids[i+2:]...)
+	db.packNode(node, keys, vals, kids)
+}
+
+func (db *KDB) maxEntry(node *Node) (string, *version) {
+	for {
+		keys, vals, kids := db.unpackNode(node)
+		if kids == nil {
+			return keys[len(keys)-1], vals[len(vals)-1]
+		}
+		node = kids[len(kids)-1]
+	}
+}
+
+func (db *KDB) minEntry(node *Node) (string, *version) {
+	for {
+		keys, vals, kids := db.unpackNode(node)
+		if kids == nil {
+			return keys[0], vals[0]
+		}
+		node = kids[0]
+	}
+}
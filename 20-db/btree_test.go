@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// TestBTreeInvariants inserts and removes random keys against a map model
+// and walks the whole 2-3-4 tree after every step: all leaves at the same
+// depth, 1-3 keys per node, keys in order, and exactly the model's entries.
+func TestBTreeInvariants(t *testing.T) {
+	db := &KDB{}
+	model := make(map[string]int64)
+	rng := rand.New(rand.NewSource(1))
+	for step := int64(1); step <= 5000; step++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(300))
+		_, present := model[key]
+		switch {
+		case present && rng.Intn(2) == 0:
+			if !db.remove(key) {
+				t.Fatalf("step %d: remove(%s) found nothing", step, key)
+			}
+			delete(model, key)
+		case present:
+			(*db.valueSlot(key)).seq = step
+			model[key] = step
+		default:
+			db.insert(key, &version{seq: step})
+			model[key] = step
+		}
+		if db.remove(fmt.Sprintf("missing%d", step)) {
+			t.Fatalf("step %d: removed a key never inserted", step)
+		}
+		checkBTree(t, db, model, step)
+	}
+	for key := range model {
+		if !db.remove(key) {
+			t.Fatalf("draining: remove(%s) found nothing", key)
+		}
+		delete(model, key)
+		checkBTree(t, db, model, -1)
+	}
+	if db.head != nil {
+		t.Fatal("tree not empty after removing every key")
+	}
+}
+
+// checkBTree walks db's tree and fails t if it breaks an invariant or
+// disagrees with model.
+func checkBTree(t *testing.T, db *KDB, model map[string]int64, step int64) {
+	t.Helper()
+	var keys []string
+	leafDepth := -1
+	var walk func(n *Node, depth int)
+	walk = func(n *Node, depth int) {
+		if n.size < 1 || n.size > 3 {
+			t.Fatalf("step %d: node with %d keys", step, n.size)
+		}
+		nodeKeys, vals, kids := db.unpackNode(n)
+		if kids == nil {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				t.Fatalf("step %d: leaves at depths %d and %d", step, leafDepth, depth)
+			}
+		}
+		for i, key := range nodeKeys {
+			if kids != nil {
+				walk(kids[i], depth+1)
+			}
+			if seq, ok := model[key]; !ok || vals[i] == nil || vals[i].seq != seq {
+				t.Fatalf("step %d: %s holds the wrong version (in model %v)", step, key, ok)
+			}
+			keys = append(keys, key)
+		}
+		if kids != nil {
+			walk(kids[len(nodeKeys)], depth+1)
+		}
+	}
+	if db.head != nil {
+		walk(db.head, 0)
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatalf("step %d: keys out of order", step)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i] == keys[i-1] {
+			t.Fatalf("step %d: %s stored twice", step, keys[i])
+		}
+	}
+	if len(keys) != len(model) || db.Size != len(model) {
+		t.Fatalf("step %d: tree holds %d keys, Size %d, model %d", step, len(keys), db.Size, len(model))
+	}
+}
@@ -0,0 +1,277 @@
+// Package bufferpool caches the fixed-size pages of a page file in a bounded
+// number of in-memory frames. Callers pin a page while they use it; pinned
+// pages are never evicted, and unpinned ones are replaced by LRU-K, writing
+// them back first if they were modified.
+package bufferpool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// PageID identifies a page by its position in the page file.
+type PageID uint32
+
+var (
+	// ErrNoFreeFrames is returned when every frame holds a pinned page, so
+	// there is nothing to evict for the page being fetched or created.
+	ErrNoFreeFrames = errors.New("bufferpool: all frames are pinned")
+	// ErrNotResident is returned for a page that is not in the pool.
+	ErrNotResident = errors.New("bufferpool: page not resident")
+	// ErrNotPinned is returned by UnpinPage for a page with no pins.
+	ErrNotPinned = errors.New("bufferpool: page not pinned")
+)
+
+// DiskManager reads and writes whole pages of the underlying file.
+type DiskManager interface {
+	// ReadPage fills buf with page id.
+	ReadPage(id PageID, buf []byte) error
+	// WritePage stores buf as page id.
+	WritePage(id PageID, buf []byte) error
+	// AllocatePage reserves a new page at the end of the file. Its contents
+	// are undefined until it is first written.
+	AllocatePage() (PageID, error)
+}
+
+// Page is a frame of the pool holding one page. Its Data may be read while
+// the page is pinned, and modified if the page is then unpinned as dirty.
+type Page struct {
+	id    PageID
+	data  []byte
+	pins  int
+	dirty bool
+}
+
+// ID returns the id of the page held in the frame.
+func (p *Page) ID() PageID {
+	return p.id
+}
+
+// Data returns the page contents.
+func (p *Page) Data() []byte {
+	return p.data
+}
+
+// Stats counts how the pool served page requests.
+type Stats struct {
+	Hits       int64 // fetches answered from a frame
+	Misses     int64 // fetches that read the page from disk
+	Evictions  int64 // pages dropped to make room
+	WriteBacks int64 // dirty pages written to disk, on eviction or flush
+}
+
+// HitRate is the fraction of fetches that did not go to disk.
+func (s Stats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Pool is a buffer pool of a fixed number of frames over a DiskManager. It
+// is safe for concurrent use; disk I/O for a miss happens under the pool's
+// lock.
+type Pool struct {
+	mu       sync.Mutex
+	disk     DiskManager
+	pageSize int
+	frames   []*Page
+	table    map[PageID]int // resident page -> frame index
+	free     []int          // frames holding no page
+	replacer *lruK
+	stats    Stats
+}
+
+// New returns a pool of capacity frames of pageSize bytes each. Eviction
+// uses LRU-K with the given k; k <= 1 degrades to plain LRU.
+func New(disk DiskManager, pageSize, capacity, k int) *Pool {
+	capacity = max(capacity, 1)
+	p := &Pool{
+		disk:     disk,
+		pageSize: pageSize,
+		frames:   make([]*Page, capacity),
+		table:    make(map[PageID]int, capacity),
+		replacer: newLRUK(capacity, max(k, 1)),
+	}
+	for i := capacity - 1; i >= 0; i-- {
+		p.frames[i] = &Page{data: make([]byte, pageSize)}
+		p.free = append(p.free, i)
+	}
+	return p
+}
+
+// FetchPage returns page id pinned, reading it from disk if it is not
+// resident. Every successful fetch must be matched by an UnpinPage.
+func (p *Pool) FetchPage(id PageID) (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f, ok := p.table[id]; ok {
+		p.stats.Hits++
+		return p.pin(f), nil
+	}
+	f, err := p.victim()
+	if err != nil {
+		return nil, err
+	}
+	page := p.frames[f]
+	if err := p.disk.ReadPage(id, page.data); err != nil {
+		p.free = append(p.free, f)
+		return nil, fmt.Errorf("fetch page %d: %w", id, err)
+	}
+	p.stats.Misses++
+	p.install(f, id)
+	return p.pin(f), nil
+}
+
+// NewPage allocates a page on disk and returns it pinned, zeroed and marked
+// dirty so it reaches the file even if the caller never modifies it.
+func (p *Pool) NewPage() (*Page, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := p.victim()
+	if err != nil {
+		return nil, err
+	}
+	id, err := p.disk.AllocatePage()
+	if err != nil {
+		p.free = append(p.free, f)
+		return nil, fmt.Errorf("allocate page: %w", err)
+	}
+	page := p.frames[f]
+	clear(page.data)
+	p.install(f, id)
+	page.dirty = true
+	return p.pin(f), nil
+}
+
+// UnpinPage drops one pin from page id. dirty records that the caller
+// modified the page; it stays dirty until written back. A page with no pins
+// left becomes a candidate for eviction.
+func (p *Pool) UnpinPage(id PageID, dirty bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, ok := p.table[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNotResident, id)
+	}
+	page := p.frames[f]
+	if page.pins == 0 {
+		return fmt.Errorf("%w: %d", ErrNotPinned, id)
+	}
+	page.dirty = page.dirty || dirty
+	page.pins--
+	if page.pins == 0 {
+		p.replacer.setEvictable(f, true)
+	}
+	return nil
+}
+
+// FlushPage writes page id to disk if it is dirty, pinned or not.
+func (p *Pool) FlushPage(id PageID) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, ok := p.table[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrNotResident, id)
+	}
+	return p.writeBack(p.frames[f])
+}
+
+// FlushAll writes every dirty resident page to disk.
+func (p *Pool) FlushAll() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, f := range p.table {
+		if err := p.writeBack(p.frames[f]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the pool's counters so far.
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Capacity returns the number of frames.
+func (p *Pool) Capacity() int {
+	return len(p.frames)
+}
+
+// Pinned returns the number of resident pages with at least one pin.
+func (p *Pool) Pinned() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, f := range p.table {
+		if p.frames[f].pins > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// victim returns a frame to load a page into: a free one if there is any,
+// otherwise the one LRU-K picks among unpinned pages, after writing it back
+// and dropping it from the table. Callers hold p.mu.
+func (p *Pool) victim() (int, error) {
+	if n := len(p.free); n > 0 {
+		f := p.free[n-1]
+		p.free = p.free[:n-1]
+		return f, nil
+	}
+	f, ok := p.replacer.evict()
+	if !ok {
+		return 0, ErrNoFreeFrames
+	}
+	page := p.frames[f]
+	if err := p.writeBack(page); err != nil {
+		// Keep the page; it is still the only copy of its contents.
+		p.replacer.recordAccess(f)
+		p.replacer.setEvictable(f, true)
+		return 0, err
+	}
+	delete(p.table, page.id)
+	p.stats.Evictions++
+	return f, nil
+}
+
+// install maps page id to frame f. Callers hold p.mu.
+func (p *Pool) install(f int, id PageID) {
+	page := p.frames[f]
+	page.id, page.pins, page.dirty = id, 0, false
+	p.table[id] = f
+}
+
+// pin adds a pin to the page in frame f and records the access. Callers
+// hold p.mu.
+func (p *Pool) pin(f int) *Page {
+	page := p.frames[f]
+	page.pins++
+	p.replacer.recordAccess(f)
+	p.replacer.setEvictable(f, false)
+	return page
+}
+
+// writeBack writes page to disk if it is dirty. Callers hold p.mu.
+func (p *Pool) writeBack(page *Page) error {
+	if !page.dirty {
+		return nil
+	}
+	if err := p.disk.WritePage(page.id, page.data); err != nil {
+		return fmt.Errorf("write back page %d: %w", page.id, err)
+	}
+	page.dirty = false
+	p.stats.WriteBacks++
+	return nil
+}
@@ -0,0 +1,251 @@
+package bufferpool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// memDisk is an in-memory DiskManager that counts its I/O.
+type memDisk struct {
+	mu            sync.Mutex
+	pageSize      int
+	pages         [][]byte
+	reads, writes int
+}
+
+func (d *memDisk) ReadPage(id PageID, buf []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if int(id) >= len(d.pages) {
+		return fmt.Errorf("page %d out of range", id)
+	}
+	copy(buf, d.pages[id])
+	d.reads++
+	return nil
+}
+
+func (d *memDisk) WritePage(id PageID, buf []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pages[id] = append(d.pages[id][:0], buf...)
+	d.writes++
+	return nil
+}
+
+func (d *memDisk) AllocatePage() (PageID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pages = append(d.pages, make([]byte, d.pageSize))
+	return PageID(len(d.pages) - 1), nil
+}
+
+// newMemDisk returns a disk of n pages, each holding its own id.
+func newMemDisk(pageSize, n int) *memDisk {
+	d := &memDisk{pageSize: pageSize}
+	for i := 0; i < n; i++ {
+		page := make([]byte, pageSize)
+		binary.LittleEndian.PutUint32(page, uint32(i))
+		d.pages = append(d.pages, page)
+	}
+	return d
+}
+
+func TestPinnedPagesAreNeverEvicted(t *testing.T) {
+	disk := newMemDisk(64, 8)
+	pool := New(disk, 64, 4, 2)
+
+	var pinned []*Page
+	for i := 0; i < 4; i++ {
+		pg, err := pool.FetchPage(PageID(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned = append(pinned, pg)
+	}
+	if _, err := pool.FetchPage(4); !errors.Is(err, ErrNoFreeFrames) {
+		t.Fatalf("fetch with every frame pinned returned %v, want ErrNoFreeFrames", err)
+	}
+	if _, err := pool.NewPage(); !errors.Is(err, ErrNoFreeFrames) {
+		t.Fatalf("new page with every frame pinned returned %v, want ErrNoFreeFrames", err)
+	}
+
+	// Freeing one frame lets exactly that page go; the other three must
+	// still be resident and intact however many pages pass through.
+	if err := pool.UnpinPage(pinned[0].ID(), false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 4; i < 8; i++ {
+		pg, err := pool.FetchPage(PageID(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pool.UnpinPage(pg.ID(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pg := range pinned[1:] {
+		if got := binary.LittleEndian.Uint32(pg.Data()); got != uint32(pg.ID()) {
+			t.Fatalf("pinned page %d now holds page %d", pg.ID(), got)
+		}
+	}
+	before := pool.Stats()
+	for _, pg := range pinned[1:] {
+		again, err := pool.FetchPage(pg.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = pool.UnpinPage(again.ID(), false)
+		_ = pool.UnpinPage(pg.ID(), false)
+	}
+	if after := pool.Stats(); after.Hits-before.Hits != 3 {
+		t.Fatalf("refetching pinned pages: %d hits, want 3", after.Hits-before.Hits)
+	}
+	if n := pool.Pinned(); n != 0 {
+		t.Fatalf("%d pages still pinned", n)
+	}
+
+	if err := pool.UnpinPage(1, false); !errors.Is(err, ErrNotPinned) {
+		t.Fatalf("unpinning an unpinned page returned %v, want ErrNotPinned", err)
+	}
+	if err := pool.UnpinPage(99, false); !errors.Is(err, ErrNotResident) {
+		t.Fatalf("unpinning a missing page returned %v, want ErrNotResident", err)
+	}
+}
+
+func TestDirtyPagesAreWrittenBack(t *testing.T) {
+	disk := newMemDisk(64, 0)
+	pool := New(disk, 64, 2, 2)
+
+	// Create more pages than frames; each is evicted while dirty and must
+	// reach the disk with what was written into it.
+	for i := 0; i < 10; i++ {
+		pg, err := pool.NewPage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(pg.Data(), fmt.Sprintf("page %d", pg.ID()))
+		if err := pool.UnpinPage(pg.ID(), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	for i, page := range disk.pages {
+		if want := fmt.Sprintf("page %d", i); string(page[:len(want)]) != want {
+			t.Fatalf("disk page %d holds %q", i, page[:len(want)])
+		}
+	}
+
+	// A clean page is not written again; flushing a pinned dirty page is.
+	writes := disk.writes
+	pg, err := pool.FetchPage(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.FlushPage(3); err != nil {
+		t.Fatal(err)
+	}
+	if disk.writes != writes {
+		t.Fatal("flushing a clean page wrote it")
+	}
+	copy(pg.Data(), "changed")
+	if err := pool.UnpinPage(3, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.FlushPage(3); err != nil {
+		t.Fatal(err)
+	}
+	if string(disk.pages[3][:7]) != "changed" {
+		t.Fatalf("flushed page 3 holds %q", disk.pages[3][:7])
+	}
+	if s := pool.Stats(); s.Evictions != 9 {
+		t.Fatalf("%d evictions, want 9", s.Evictions)
+	}
+}
+
+func TestLRUKResistsScans(t *testing.T) {
+	hits := func(k int) int64 {
+		disk := newMemDisk(64, 200)
+		pool := New(disk, 64, 8, k)
+		touch := func(id int) {
+			pg, err := pool.FetchPage(PageID(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pool.UnpinPage(pg.ID(), false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Pages 0-3 are hot: used twice. Then a scan reads 100 pages once
+		// each, and the hot pages are used again.
+		for round := 0; round < 2; round++ {
+			for id := 0; id < 4; id++ {
+				touch(id)
+			}
+		}
+		for id := 100; id < 200; id++ {
+			touch(id)
+		}
+		before := pool.Stats().Hits
+		for id := 0; id < 4; id++ {
+			touch(id)
+		}
+		return pool.Stats().Hits - before
+	}
+
+	lru, lru2 := hits(1), hits(2)
+	if lru2 != 4 {
+		t.Fatalf("LRU-2 kept %d of 4 hot pages through the scan", lru2)
+	}
+	t.Logf("hot pages surviving a scan: LRU %d/4, LRU-2 %d/4", lru, lru2)
+}
+
+// TestConcurrentFetchers is meant to run under the race detector:
+// `go test -race ./20-db/bufferpool`.
+func TestConcurrentFetchers(t *testing.T) {
+	const workers = 4
+	disk := newMemDisk(64, 64)
+	// One frame per worker: each holds at most one pin, so a fetch can
+	// always find a victim.
+	pool := New(disk, 64, workers, 2)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 2000; i++ {
+				id := PageID(rng.Intn(64))
+				pg, err := pool.FetchPage(id)
+				if err != nil {
+					errs <- err
+					return
+				}
+				got := binary.LittleEndian.Uint32(pg.Data())
+				if err := pool.UnpinPage(id, false); err != nil {
+					errs <- err
+					return
+				}
+				if got != uint32(id) {
+					errs <- fmt.Errorf("page %d holds page %d", id, got)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.Pinned(); n != 0 {
+		t.Fatalf("%d pages still pinned", n)
+	}
+}
@@ -0,0 +1,64 @@
+package bufferpool
+
+// lruK picks eviction victims by LRU-K: the frame whose K-th most recent
+// access lies furthest in the past. Frames accessed fewer than K times count
+// as infinitely far and go first, oldest first access breaking ties. Unlike
+// plain LRU, a page touched once by a scan cannot push out pages that are
+// used repeatedly.
+type lruK struct {
+	k     int
+	now   int64 // logical clock, bumped on every access
+	nodes []lruKNode
+}
+
+type lruKNode struct {
+	history   []int64 // up to k most recent accesses, oldest first
+	evictable bool
+}
+
+func newLRUK(frames, k int) *lruK {
+	return &lruK{k: k, nodes: make([]lruKNode, frames)}
+}
+
+// recordAccess notes an access to frame f at the current time.
+func (r *lruK) recordAccess(f int) {
+	r.now++
+	n := &r.nodes[f]
+	if len(n.history) == r.k {
+		n.history = append(n.history[:0], n.history[1:]...)
+	}
+	n.history = append(n.history, r.now)
+}
+
+// setEvictable marks whether frame f may be chosen by evict.
+func (r *lruK) setEvictable(f int, evictable bool) {
+	r.nodes[f].evictable = evictable
+}
+
+// evict picks the victim among evictable frames with history and forgets
+// it. It reports false if there is none.
+func (r *lruK) evict() (int, bool) {
+	victim, victimFull := -1, true
+	var victimTime int64
+	for f := range r.nodes {
+		n := &r.nodes[f]
+		if !n.evictable || len(n.history) == 0 {
+			continue
+		}
+		// For full histories history[0] is the K-th most recent access;
+		// otherwise it is the first. Either way the smallest wins within
+		// a class, and the class with fewer than K accesses wins outright.
+		full := len(n.history) == r.k
+		switch {
+		case victim < 0,
+			victimFull && !full,
+			victimFull == full && n.history[0] < victimTime:
+			victim, victimFull, victimTime = f, full, n.history[0]
+		}
+	}
+	if victim < 0 {
+		return 0, false
+	}
+	r.nodes[victim] = lruKNode{history: r.nodes[victim].history[:0]}
+	return victim, true
+}
@@ -0,0 +1,199 @@
+// Package client talks to a KDB server (`go run ./20-db serve`) over its
+// RESP protocol. Any Redis client works as well; this one is small and
+// covers the commands the server implements.
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golangdsa/20-db/resp"
+)
+
+// DefaultTimeout bounds connecting and each round trip of a new Client.
+const DefaultTimeout = 5 * time.Second
+
+// Client is a connection to a KDB server. It is safe for concurrent use;
+// commands from different goroutines are sent one at a time.
+type Client struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *resp.Reader
+	w       *resp.Writer
+	timeout time.Duration
+}
+
+// Dial connects to the server at addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: resp.NewReader(conn), w: resp.NewWriter(conn), timeout: DefaultTimeout}, nil
+}
+
+// SetTimeout sets how long a command, or a pipeline of them, may take from
+// sending it to reading the last reply; 0 waits forever. A command that
+// runs out of time closes the connection.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = d
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends one command and returns the reply. An error reply from the
+// server is returned as a resp.Error.
+func (c *Client) Do(args ...string) (resp.Value, error) {
+	vals, err := c.roundTrip([][]string{args})
+	if err != nil {
+		return resp.Value{}, err
+	}
+	return vals[0], vals[0].Err()
+}
+
+// roundTrip writes every command in one go and then reads their replies,
+// so a batch costs a single network round trip.
+func (c *Client) roundTrip(cmds [][]string) ([]resp.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for _, args := range cmds {
+		c.w.WriteCommand(args...)
+	}
+	if err := c.w.Flush(); err != nil {
+		// Part of a command may have gone out, which the server would
+		// take as the start of the next one.
+		c.conn.Close()
+		return nil, err
+	}
+	vals := make([]resp.Value, len(cmds))
+	for i := range vals {
+		v, err := c.r.ReadValue()
+		if err != nil {
+			// The replies still in flight would be read as answers to the
+			// next command, so the connection is no use any more.
+			c.conn.Close()
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func (c *Client) Ping() error {
+	_, err := c.Do("PING")
+	return err
+}
+
+// Get returns the value of key; ok is false if the key does not exist.
+func (c *Client) Get(key string) (val string, ok bool, err error) {
+	v, err := c.Do("GET", key)
+	if err != nil || v.Null {
+		return "", false, err
+	}
+	return v.Str, true, nil
+}
+
+func (c *Client) Set(key, val string) error {
+	_, err := c.Do("SET", key, val)
+	return err
+}
+
+// SetTTL stores val under key until ttl has passed. The server counts in
+// milliseconds, so ttl is rounded up to the next one: a TTL under a
+// millisecond still stores the key, briefly, rather than being refused.
+func (c *Client) SetTTL(key, val string, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ttl > 0 && ttl%time.Millisecond != 0 {
+		ms++
+	}
+	_, err := c.Do("SET", key, val, "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Del deletes keys and returns how many of them existed.
+func (c *Client) Del(keys ...string) (int64, error) {
+	v, err := c.Do(append([]string{"DEL"}, keys...)...)
+	return v.Int, err
+}
+
+// Exists returns how many of keys exist, counting repeated keys each time.
+func (c *Client) Exists(keys ...string) (int64, error) {
+	v, err := c.Do(append([]string{"EXISTS"}, keys...)...)
+	return v.Int, err
+}
+
+// Scan returns a batch of keys matching the glob pattern match (all keys if
+// it is empty) and the cursor to pass to the next call. Iteration starts
+// and ends at cursor 0; count hints how many keys to look at per call.
+func (c *Client) Scan(cursor uint64, match string, count int) (keys []string, next uint64, err error) {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+	v, err := c.Do(args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(v.Elems) != 2 {
+		return nil, 0, fmt.Errorf("client: malformed SCAN reply")
+	}
+	if next, err = strconv.ParseUint(v.Elems[0].Str, 10, 64); err != nil {
+		return nil, 0, fmt.Errorf("client: bad SCAN cursor %q", v.Elems[0].Str)
+	}
+	for _, k := range v.Elems[1].Elems {
+		keys = append(keys, k.Str)
+	}
+	return keys, next, nil
+}
+
+// Info returns the server's INFO report.
+func (c *Client) Info() (string, error) {
+	v, err := c.Do("INFO")
+	return v.Str, err
+}
+
+// Pipeline queues commands and sends them together.
+type Pipeline struct {
+	c    *Client
+	cmds [][]string
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues a command.
+func (p *Pipeline) Do(args ...string) {
+	p.cmds = append(p.cmds, args)
+}
+
+// Exec sends the queued commands and returns their replies in order; error
+// replies are returned as values, not as err. The pipeline is empty again
+// afterwards.
+func (p *Pipeline) Exec() ([]resp.Value, error) {
+	if len(p.cmds) == 0 {
+		return nil, nil
+	}
+	cmds := p.cmds
+	p.cmds = nil
+	return p.c.roundTrip(cmds)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golangdsa/20-db/resp"
+)
+
+// pipeClient returns a Client talking to serve over an in-memory pipe.
+func pipeClient(t *testing.T, serve func(r *resp.Reader, w *resp.Writer)) *Client {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { conn.Close(); peer.Close() })
+	go serve(resp.NewReader(peer), resp.NewWriter(peer))
+	return &Client{conn: conn, r: resp.NewReader(conn), w: resp.NewWriter(conn), timeout: DefaultTimeout}
+}
+
+func TestSetTTLRoundsUpToMilliseconds(t *testing.T) {
+	sent := make(chan string, 1)
+	c := pipeClient(t, func(r *resp.Reader, w *resp.Writer) {
+		for {
+			args, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			sent <- args[len(args)-1]
+			w.WriteSimple("OK")
+			w.Flush()
+		}
+	})
+	for _, tt := range []struct {
+		ttl  time.Duration
+		want string
+	}{
+		{time.Microsecond, "1"},
+		{999 * time.Microsecond, "1"},
+		{time.Millisecond, "1"},
+		{1500 * time.Microsecond, "2"},
+		{time.Second, "1000"},
+	} {
+		if err := c.SetTTL("k", "v", tt.ttl); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-sent; got != tt.want {
+			t.Errorf("SetTTL(%v) sent PX %s, want %s", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestTimeoutClosesConnection(t *testing.T) {
+	c := pipeClient(t, func(r *resp.Reader, w *resp.Writer) {
+		r.ReadCommand() // and never answer
+	})
+	c.SetTimeout(20 * time.Millisecond)
+	if err := c.Ping(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Ping returned %v, want a deadline error", err)
+	}
+	if err := c.Ping(); err == nil {
+		t.Fatal("Ping succeeded on a connection that timed out")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Values are Go strings inside the DB, but a Go string is just an immutable
+// byte sequence: the WAL and SSTable formats store every value with an
+// explicit length, so any bytes, including invalid UTF-8 and zero bytes,
+// round-trip through both unchanged. The byte-slice APIs below are a
+// convenience, not a fast path: converting between []byte and string copies
+// the value once on the way in and once on the way out, which also keeps
+// callers from mutating a stored value through their slice.
+
+// PutBytes stores a copy of val under key, overwriting any previous value.
+// It costs the same as Put(key, string(val)).
+func (db *KDB) PutBytes(key string, val []byte) error {
+	return db.Put(key, string(val))
+}
+
+// GetBytes is Get for binary values. The returned slice is a fresh copy of
+// the stored value and the caller's to modify.
+func (db *KDB) GetBytes(key string) ([]byte, bool, error) {
+	v, ok, err := db.Get(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return []byte(v), true, nil
+}
+
+// PutBytes adds a write of a copy of val under key to the batch.
+func (b *WriteBatch) PutBytes(key string, val []byte) {
+	b.Put(key, string(val))
+}
+
+// Codec converts values of type V to and from the bytes stored in the DB.
+type Codec[V any] interface {
+	Encode(v V) ([]byte, error)
+	Decode(data []byte) (V, error)
+}
+
+// JSONCodec stores values as JSON.
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Encode(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Decode(data []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec stores values in encoding/gob format. Each value carries its own
+// type description, so it is larger than JSON for small values but decodes
+// any Go type gob supports without struct tags.
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Encode(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[V]) Decode(data []byte) (V, error) {
+	var v V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// RawCodec stores byte slices as they are.
+type RawCodec struct{}
+
+func (RawCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (RawCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+var (
+	_ Codec[any]    = JSONCodec[any]{}
+	_ Codec[any]    = GobCodec[any]{}
+	_ Codec[[]byte] = RawCodec{}
+)
+
+// Typed is a view of a Backend whose values are of type V, converted by a
+// Codec. It shares the key space with every other user of the backend: Get
+// on a key written in another format returns the codec's decode error.
+type Typed[V any] struct {
+	db    Backend
+	codec Codec[V]
+}
+
+// NewTyped returns a view of db that stores values of type V with codec.
+func NewTyped[V any](db Backend, codec Codec[V]) *Typed[V] {
+	return &Typed[V]{db: db, codec: codec}
+}
+
+// Put encodes v and stores it under key.
+func (t *Typed[V]) Put(key string, v V) error {
+	data, err := t.codec.Encode(v)
+	if err != nil {
+		return fmt.Errorf("encode value for %q: %w", key, err)
+	}
+	return t.db.Put(key, string(data))
+}
+
+// Get returns the decoded value of key. ok is false if the key has no live
+// value; err is set if it has one that the codec cannot decode, or if the
+// DB fails to read it.
+func (t *Typed[V]) Get(key string) (v V, ok bool, err error) {
+	s, ok, err := t.db.Get(key)
+	if err != nil || !ok {
+		return v, false, err
+	}
+	v, err = t.codec.Decode([]byte(s))
+	if err != nil {
+		return v, true, fmt.Errorf("decode value of %q: %w", key, err)
+	}
+	return v, true, nil
+}
+
+// Delete removes key.
+func (t *Typed[V]) Delete(key string) error {
+	return t.db.Delete(key)
+}
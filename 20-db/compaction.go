@@ -0,0 +1,413 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// maxLevels is the number of LSM levels, L0 included.
+const maxLevels = 7
+
+// CompactionStrategy selects how background compaction picks tables.
+type CompactionStrategy int
+
+const (
+	// CompactionSizeTiered keeps every table in level 0 and merges runs of
+	// adjacent tables that have grown to a similar size.
+	CompactionSizeTiered CompactionStrategy = iota
+	// CompactionLeveled pushes level-0 tables into non-overlapping levels
+	// whose byte budgets grow geometrically.
+	CompactionLeveled
+	// CompactionNone disables background compaction.
+	CompactionNone
+)
+
+func (s CompactionStrategy) String() string {
+	switch s {
+	case CompactionSizeTiered:
+		return "size-tiered"
+	case CompactionLeveled:
+		return "leveled"
+	case CompactionNone:
+		return "none"
+	}
+	return fmt.Sprintf("CompactionStrategy(%d)", int(s))
+}
+
+// compaction describes one merge picked by a strategy.
+type compaction struct {
+	inputs []*SSTable // newest first, so the merge keeps the latest version
+	output int        // level the merged tables go to
+	// below holds every table that is older than the inputs and outside the
+	// compaction. A tombstone can only be dropped if none of them may still
+	// hold the key it shadows.
+	below []*SSTable
+	// split is the output size at which a new table is started; 0 writes a
+	// single output table.
+	split int64
+	// oldestSnapshot is the sequence number of the oldest snapshot or
+	// transaction open when the compaction was picked. Deletes newer than it
+	// are kept as tombstones: a transaction that began before one must still
+	// find it when it checks the key for conflicts.
+	oldestSnapshot int64
+}
+
+// startCompactor launches the background compaction goroutine.
+func (db *KDB) startCompactor() {
+	if db.opts.Compaction == CompactionNone {
+		return
+	}
+	db.compactCh = make(chan struct{}, 1)
+	db.compactWG.Add(1)
+	go db.compactLoop()
+	db.scheduleCompaction()
+}
+
+// stopCompactor waits for an in-flight compaction to finish and returns the
+// last error the background goroutine ran into, if any.
+func (db *KDB) stopCompactor() error {
+	if db.compactCh == nil {
+		return nil
+	}
+	close(db.compactCh)
+	db.compactWG.Wait()
+	db.compactCh = nil
+	return db.compactErr
+}
+
+// scheduleCompaction wakes the compactor without blocking the caller.
+func (db *KDB) scheduleCompaction() {
+	if db.compactCh == nil {
+		return
+	}
+	select {
+	case db.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+func (db *KDB) compactLoop() {
+	defer db.compactWG.Done()
+	for range db.compactCh {
+		for {
+			did, err := db.compactOnce()
+			if err != nil {
+				db.mu.Lock()
+				db.compactErr = err
+				db.mu.Unlock()
+				break
+			}
+			if !did {
+				break
+			}
+		}
+	}
+}
+
+// compactOnce runs a single compaction if the strategy asks for one and
+// reports whether it did any work.
+func (db *KDB) compactOnce() (bool, error) {
+	db.mu.Lock()
+	var c *compaction
+	switch db.opts.Compaction {
+	case CompactionSizeTiered:
+		c = db.pickSizeTiered()
+	case CompactionLeveled:
+		c = db.pickLeveled()
+	}
+	if c != nil {
+		c.oldestSnapshot = db.oldestSnapshot()
+	}
+	db.mu.Unlock()
+	if c == nil {
+		return false, nil
+	}
+
+	outputs, err := db.runCompaction(c)
+	if err != nil {
+		return false, err
+	}
+	if err := db.installCompaction(c, outputs); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// pickSizeTiered looks for the oldest run of at least MinMergeWidth adjacent
+// level-0 tables whose sizes are within a factor of two of the run's
+// average. Only adjacent tables are merged so the result can take the run's
+// place in the newest-to-oldest read order.
+func (db *KDB) pickSizeTiered() *compaction {
+	tables := db.levels[0]
+	for start := 0; start < len(tables); start++ {
+		end := start + 1
+		total := tables[start].size
+		for end < len(tables) {
+			avg := total / int64(end-start)
+			if s := tables[end].size; s > 2*avg || 2*s < avg {
+				break
+			}
+			total += tables[end].size
+			end++
+		}
+		if end-start < db.opts.MinMergeWidth {
+			continue
+		}
+
+		c := &compaction{output: 0}
+		for i := end - 1; i >= start; i-- {
+			c.inputs = append(c.inputs, tables[i])
+		}
+		c.below = append(c.below, tables[:start]...)
+		for _, deeper := range db.levels[1:] {
+			c.below = append(c.below, deeper...)
+		}
+		return c
+	}
+	return nil
+}
+
+// pickLeveled moves all of level 0 into level 1 once it has
+// L0CompactionTrigger tables, and otherwise pushes one table from the first
+// level that is over its byte budget into the next level.
+func (db *KDB) pickLeveled() *compaction {
+	if len(db.levels[0]) >= db.opts.L0CompactionTrigger {
+		c := &compaction{output: 1, split: db.opts.TargetFileSize}
+		for i := len(db.levels[0]) - 1; i >= 0; i-- {
+			c.inputs = append(c.inputs, db.levels[0][i])
+		}
+		lo, hi := keyRange(c.inputs)
+		c.inputs = append(c.inputs, overlapping(db.levels[1], lo, hi)...)
+		c.below = db.tablesFrom(2)
+		return c
+	}
+
+	limit := db.opts.BaseLevelSize
+	for level := 1; level < maxLevels-1; level++ {
+		if levelSize(db.levels[level]) > limit {
+			t := db.nextLeveledInput(level)
+			c := &compaction{
+				inputs: []*SSTable{t},
+				output: level + 1,
+				split:  db.opts.TargetFileSize,
+				below:  db.tablesFrom(level + 2),
+			}
+			c.inputs = append(c.inputs, overlapping(db.levels[level+1], t.minKey, t.maxKey)...)
+			return c
+		}
+		limit *= int64(db.opts.LevelSizeMultiplier)
+	}
+	return nil
+}
+
+// nextLeveledInput picks the table of level to push down, cycling through
+// the key space so every table eventually gets compacted.
+func (db *KDB) nextLeveledInput(level int) *SSTable {
+	tables := db.levels[level]
+	for _, t := range tables {
+		if t.minKey > db.compactPointer[level] {
+			db.compactPointer[level] = t.maxKey
+			return t
+		}
+	}
+	db.compactPointer[level] = tables[0].maxKey
+	return tables[0]
+}
+
+// tablesFrom returns every table in level and the levels below it.
+func (db *KDB) tablesFrom(level int) []*SSTable {
+	var out []*SSTable
+	for ; level < maxLevels; level++ {
+		out = append(out, db.levels[level]...)
+	}
+	return out
+}
+
+// runCompaction merges the inputs in key order, keeping only the newest
+// version of each key and dropping tombstones nothing older can see, and
+// writes the result to new tables. Expired values are dead too: they go
+// the same way, or stay behind as tombstones while older tables may still
+// hold a value they hide. Either kind stays, as a tombstone, if it is newer
+// than the oldest open snapshot. The older versions a newer one shadows can
+// go whatever the snapshots: each snapshot reads the tables it pinned, not
+// the outputs.
+func (db *KDB) runCompaction(c *compaction) ([]*SSTable, error) {
+	sources := make([]recordIterator, 0, len(c.inputs))
+	for _, t := range c.inputs {
+		sources = append(sources, newTableIterator(t, IterOptions{}))
+	}
+	in := newRecordMerger(sources)
+	now := db.now()
+	next := func() (kvEntry, bool) {
+		for ; in.Valid(); in.Next() {
+			e := in.entry()
+			if !e.live(now) {
+				if e.seq <= c.oldestSnapshot && !mayContainAny(c.below, e.key) {
+					continue
+				}
+				e.val, e.expires = nil, 0
+			}
+			in.Next()
+			return e, true
+		}
+		return kvEntry{}, false
+	}
+
+	// The merge streams straight into the outputs, a block of each input
+	// at a time, cutting a new table every c.split bytes.
+	var outputs []*SSTable
+	abort := func(err error) ([]*SSTable, error) {
+		for _, o := range outputs {
+			_ = o.Close()
+			_ = db.opts.FS.Remove(o.path)
+		}
+		return nil, err
+	}
+	e, ok := next()
+	for ok {
+		db.mu.Lock()
+		db.nextTable++
+		num := db.nextTable
+		db.mu.Unlock()
+
+		t, err := writeSSTable(db.tablePath(num), db.opts, func(fn func(e kvEntry)) {
+			var size int64
+			for ok && (c.split <= 0 || size == 0 || size < c.split) {
+				fn(e)
+				size += int64(len(e.key))
+				if e.val != nil {
+					size += int64(len(*e.val))
+				}
+				e, ok = next()
+			}
+		})
+		if err != nil {
+			return abort(fmt.Errorf("compaction write: %w", err))
+		}
+		t.num, t.level = num, c.output
+		outputs = append(outputs, t)
+	}
+	if err := in.Close(); err != nil {
+		return abort(fmt.Errorf("compaction read: %w", err))
+	}
+	return outputs, nil
+}
+
+// installCompaction swaps the inputs for the outputs in the table set and
+// persists the change through the manifest before deleting the old files.
+func (db *KDB) installCompaction(c *compaction, outputs []*SSTable) error {
+	inputs := make(map[*SSTable]bool, len(c.inputs))
+	for _, t := range c.inputs {
+		inputs[t] = true
+	}
+
+	db.mu.Lock()
+	prev, prevStats := slices.Clone(db.levels), db.retiredFilterStats
+	edit := versionEdit{NextTable: db.nextTable}
+	for _, t := range c.inputs {
+		edit.Deleted = append(edit.Deleted, t.num)
+	}
+	insertAt := -1
+	for level, tables := range db.levels {
+		kept := make([]*SSTable, 0, len(tables))
+		for _, t := range tables {
+			if inputs[t] {
+				if level == 0 && insertAt == -1 {
+					insertAt = len(kept)
+				}
+				continue
+			}
+			kept = append(kept, t)
+		}
+		db.levels[level] = kept
+	}
+
+	for _, t := range c.inputs {
+		db.retiredFilterStats = db.retiredFilterStats.add(t.FilterStats())
+	}
+	for i, t := range outputs {
+		mt := manifestTable{Num: t.num, Level: c.output}
+		if c.output == 0 {
+			mt.Pos = insertAt + i
+		}
+		edit.Added = append(edit.Added, mt)
+	}
+	if c.output == 0 {
+		// Size-tiered: the merged table takes the run's slot in L0.
+		l0 := append([]*SSTable{}, db.levels[0][:insertAt]...)
+		l0 = append(l0, outputs...)
+		db.levels[0] = append(l0, db.levels[0][insertAt:]...)
+	} else {
+		level := append(slices.Clone(db.levels[c.output]), outputs...)
+		sort.Slice(level, func(i, j int) bool { return level[i].minKey < level[j].minKey })
+		db.levels[c.output] = level
+	}
+	err := db.logEdit(edit)
+	if err != nil {
+		db.levels, db.retiredFilterStats = prev, prevStats
+	}
+	db.mu.Unlock()
+	if err != nil {
+		for _, t := range outputs {
+			t.unref() // orphans now; Open deletes them
+		}
+		return err
+	}
+
+	// Get holds db.mu for as long as it touches tables, so only snapshots
+	// and iterators, which pin the tables they read, can still reach the
+	// inputs; the last one to let go deletes them.
+	for _, t := range c.inputs {
+		t.obsolete.Store(true)
+		t.unref()
+	}
+	return nil
+}
+
+// keyRange returns the smallest and largest key covered by tables.
+func keyRange(tables []*SSTable) (string, string) {
+	var lo, hi string
+	first := true
+	for _, t := range tables {
+		if t.keys == 0 {
+			continue
+		}
+		if first || t.minKey < lo {
+			lo = t.minKey
+		}
+		if first || t.maxKey > hi {
+			hi = t.maxKey
+		}
+		first = false
+	}
+	return lo, hi
+}
+
+// overlapping returns the tables whose key range intersects [lo, hi].
+func overlapping(tables []*SSTable, lo, hi string) []*SSTable {
+	var out []*SSTable
+	for _, t := range tables {
+		if t.overlaps(lo, hi) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func levelSize(tables []*SSTable) int64 {
+	var n int64
+	for _, t := range tables {
+		n += t.size
+	}
+	return n
+}
+
+func mayContainAny(tables []*SSTable, key string) bool {
+	for _, t := range tables {
+		if t.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
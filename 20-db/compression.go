@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression compresses SSTable data blocks and WAL records. Files record
+// the ID of the codec they were written with, so a DB can hold files
+// written with different codecs and read all of them back.
+type Compression interface {
+	// ID identifies the codec in file metadata. It must be unique among
+	// registered codecs and must never change once files use it; 0 is
+	// NoCompression.
+	ID() byte
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+// The built-in codecs.
+var (
+	NoCompression    Compression = noCompression{}
+	FlateCompression Compression = &flateCompression{}
+	GzipCompression  Compression = &gzipCompression{}
+)
+
+// ErrUnknownCompression is returned for a file written with a codec that is
+// not registered.
+var ErrUnknownCompression = errors.New("kdb: unknown compression codec")
+
+var (
+	compressionMu sync.RWMutex
+	compressions  = map[byte]Compression{
+		NoCompression.ID():    NoCompression,
+		FlateCompression.ID(): FlateCompression,
+		GzipCompression.ID():  GzipCompression,
+	}
+)
+
+// RegisterCompression makes c available for reading files written with it.
+// Codecs used in Options are registered implicitly when the DB opens. A
+// codec with the ID and name of a registered one replaces it, so the same
+// codec may be registered again, in another configuration too; an ID held
+// by a codec of another name is an error.
+func RegisterCompression(c Compression) error {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	// Codecs are told apart by ID and name: comparing the interface values
+	// would panic on a codec type that is not comparable.
+	if old, ok := compressions[c.ID()]; ok && old.Name() != c.Name() {
+		return fmt.Errorf("kdb: compression id %d already used by %s", c.ID(), old.Name())
+	}
+	compressions[c.ID()] = c
+	return nil
+}
+
+// compressionByID returns the registered codec with the given ID.
+func compressionByID(id byte) (Compression, error) {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+	c, ok := compressions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrUnknownCompression, id)
+	}
+	return c, nil
+}
+
+type noCompression struct{}
+
+func (noCompression) ID() byte                              { return 0 }
+func (noCompression) Name() string                          { return "none" }
+func (noCompression) Compress(src []byte) ([]byte, error)   { return src, nil }
+func (noCompression) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+// flateCompression is raw DEFLATE. Writers are pooled: each one allocates
+// several hundred KiB of state, far more than a block.
+type flateCompression struct {
+	writers sync.Pool
+}
+
+func (*flateCompression) ID() byte     { return 1 }
+func (*flateCompression) Name() string { return "flate" }
+
+func (c *flateCompression) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (*flateCompression) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// gzipCompression is DEFLATE in gzip framing, which adds a header and a
+// CRC32 of the uncompressed data to every block.
+type gzipCompression struct {
+	writers sync.Pool
+}
+
+func (*gzipCompression) ID() byte     { return 2 }
+func (*gzipCompression) Name() string { return "gzip" }
+
+func (c *gzipCompression) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := c.writers.Get().(*gzip.Writer)
+	if w == nil {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w.Reset(&buf)
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (*gzipCompression) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// levelFlate is a custom codec whose level only matters when compressing.
+// Like a codec holding a dictionary or buffers, it is not comparable.
+type levelFlate struct {
+	level int
+	dict  []byte
+}
+
+func (levelFlate) ID() byte     { return 200 }
+func (levelFlate) Name() string { return "level-flate" }
+
+func (c levelFlate) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (levelFlate) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// otherCodec claims levelFlate's ID under another name.
+type otherCodec struct{ levelFlate }
+
+func (otherCodec) Name() string { return "other" }
+
+// TestCustomCompressionReopen opens a DB with a custom codec, then again
+// with the same codec at another level, reading back what both wrote to
+// the WAL and to SSTables.
+func TestCustomCompressionReopen(t *testing.T) {
+	dir := t.TempDir()
+	want := make(map[string]string)
+	for round, level := range []int{flate.BestSpeed, flate.BestCompression} {
+		codec := levelFlate{level: level, dict: []byte("kdb")}
+		opts := Options{Compression: codec}
+		opts.WAL.Compression = codec
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatalf("open %d: %v", round, err)
+		}
+		checkContents(t, db, want)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("r%d-key%03d", round, i)
+			want[key] = fmt.Sprintf("value %d", i)
+			if err := db.Put(key, want[key]); err != nil {
+				t.Fatal(err)
+			}
+			if i == 50 {
+				if err := db.Checkpoint(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, db, want)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterCompression(otherCodec{}); err == nil {
+		t.Fatal("registered a codec under an ID another codec holds")
+	}
+	_, err = Open(t.TempDir(), Options{Compression: otherCodec{}})
+	if err == nil {
+		t.Fatalf("open with a clashing codec: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parameters of the crash run.
+const (
+	crashRounds  = 100
+	crashLives   = 4 // crashes per round
+	crashOps     = 300
+	crashKeys    = 64
+	crashDir     = "/kdb"
+	crashMaxCall = 1500 // CrashAfter is drawn from [1, crashMaxCall]
+)
+
+// crashStats adds up what the crash rounds did.
+type crashStats struct {
+	crashes, openCrashes int
+	injected             int
+	acked, failed        int
+	survived             int // failed writes whose value recovery brought back
+}
+
+// crashSeed replays the rounds of a failed run, whose seed the test logs.
+var crashSeed = flag.Int64("crashseed", 0, "seed of the first TestCrashRecovery round; 0 picks one")
+
+// TestCrashRecovery runs randomized rounds against a DB on a FaultFS. Each
+// round opens the DB a few times, writes until the file system kills it at
+// a random call, possibly after injecting write and fsync failures, and
+// checks that reopening it after the crash recovers every acknowledged
+// write, and nothing but acknowledged writes or writes that failed. Rerun a
+// failure with `go test -run CrashRecovery ./20-db -crashseed <seed>`; the
+// background compactor makes a seed reproduce it only most of the time.
+func TestCrashRecovery(t *testing.T) {
+	rounds, seed := crashRounds, *crashSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if testing.Short() {
+		rounds /= 10
+	}
+
+	var stats crashStats
+	for i := 0; i < rounds; i++ {
+		if err := crashRound(seed+int64(i), &stats); err != nil {
+			t.Fatalf("round %d (seed %d): %v", i, seed+int64(i), err)
+		}
+	}
+	t.Logf("%d rounds from seed %d: %d crashes (%d during Open), %d injected faults",
+		rounds, seed, stats.crashes, stats.openCrashes, stats.injected)
+	t.Logf("%d acknowledged writes all recovered; %d of %d failed writes survived",
+		stats.acked, stats.survived, stats.failed)
+}
+
+// crashRound runs one DB through crashLives crashes with options drawn
+// from seed.
+func crashRound(seed int64, stats *crashStats) error {
+	rng := rand.New(rand.NewSource(seed))
+	fs := NewFaultFS(seed)
+	opts := Options{
+		MemtableSize: 256 << rng.Intn(4),
+		Compaction:   []CompactionStrategy{CompactionNone, CompactionSizeTiered, CompactionLeveled}[rng.Intn(3)],
+		BlockSize:    128,
+		WAL: WALOptions{
+			SegmentSize: 512 << rng.Intn(4),
+			Sync:        []SyncPolicy{SyncEveryWrite, SyncGroupCommit}[rng.Intn(2)],
+		},
+		ReapInterval: -1,
+	}
+	if rng.Intn(2) == 0 {
+		opts.Compression = FlateCompression
+	}
+
+	m := &crashModel{acked: make(map[string]*string), pending: make(map[string][]*string)}
+	for life := 0; life < crashLives; life++ {
+		faults := Faults{CrashAfter: 1 + rng.Intn(crashMaxCall), TornWrites: rng.Intn(2) == 0}
+		if rng.Intn(2) == 0 {
+			faults.WriteErrorRate, faults.SyncErrorRate = 0.005, 0.005
+		}
+		fs.SetFaults(faults)
+		opts.FS = fs
+		db, err := Open(crashDir, opts)
+		switch {
+		case err == nil:
+			err = m.run(db, fs, rng, stats)
+			_ = db.Close()
+			if err != nil {
+				return err
+			}
+		case isInjected(err):
+			stats.openCrashes++
+		default:
+			return fmt.Errorf("open: %w", err)
+		}
+		stats.injected += fs.Injected()
+		stats.crashes++
+
+		fs = fs.Crash()
+		opts.FS = fs
+		db, err = Open(crashDir, opts)
+		if err != nil {
+			return fmt.Errorf("recover from crash %d: %w", life+1, err)
+		}
+		err = m.verify(db, stats)
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("after crash %d: %w", life+1, err)
+		}
+	}
+	return nil
+}
+
+// isInjected reports whether err comes from a fault the FaultFS injected,
+// which is the only reason a write may fail in a crash round.
+func isInjected(err error) bool {
+	return errors.Is(err, ErrInjected) || errors.Is(err, ErrCrashed)
+}
+
+// crashModel tracks what the DB may hold for each key: the value of the
+// last acknowledged write (nil for none or a delete), or the value of any
+// write to the key that failed since, which may or may not have reached the
+// disk.
+type crashModel struct {
+	acked   map[string]*string
+	pending map[string][]*string
+}
+
+type crashWrite struct {
+	key string
+	val *string // nil deletes
+}
+
+// record accounts for writes applied together, which err says failed or
+// were acknowledged.
+func (m *crashModel) record(err error, stats *crashStats, writes ...crashWrite) error {
+	for _, w := range writes {
+		if err == nil {
+			m.acked[w.key] = w.val
+			delete(m.pending, w.key)
+			stats.acked++
+		} else {
+			m.pending[w.key] = append(m.pending[w.key], w.val)
+			stats.failed++
+		}
+	}
+	if err != nil && !isInjected(err) {
+		return fmt.Errorf("write failed without an injected fault: %w", err)
+	}
+	return nil
+}
+
+// run writes to db until its file system is killed or crashOps writes are
+// done.
+func (m *crashModel) run(db *KDB, fs *FaultFS, rng *rand.Rand, stats *crashStats) error {
+	for i := 0; i < crashOps && !fs.Crashed(); i++ {
+		key := fmt.Sprintf("key%02d", rng.Intn(crashKeys))
+		val := fmt.Sprintf("%s-%d", key, stats.acked+stats.failed)
+		if rng.Intn(10) == 0 {
+			val += strings.Repeat("x", rng.Intn(512))
+		}
+		var err error
+		switch r := rng.Intn(100); {
+		case r < 55:
+			err = m.record(db.Put(key, val), stats, crashWrite{key, &val})
+		case r < 65:
+			err = m.record(db.PutWithTTL(key, val, time.Hour), stats, crashWrite{key, &val})
+		case r < 80:
+			err = m.record(db.Delete(key), stats, crashWrite{key, nil})
+		case r < 95:
+			var b WriteBatch
+			var writes []crashWrite
+			for j := 0; j < 2+rng.Intn(3); j++ {
+				k := fmt.Sprintf("key%02d", rng.Intn(crashKeys))
+				if rng.Intn(4) == 0 {
+					b.Delete(k)
+					writes = append(writes, crashWrite{k, nil})
+					continue
+				}
+				v := fmt.Sprintf("%s-%d.%d", k, stats.acked+stats.failed, j)
+				b.Put(k, v)
+				writes = append(writes, crashWrite{k, &v})
+			}
+			err = m.record(db.Write(&b), stats, writes...)
+		default:
+			if cerr := db.Checkpoint(); cerr != nil && !isInjected(cerr) {
+				err = fmt.Errorf("checkpoint failed without an injected fault: %w", cerr)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks every key of the recovered db against the model, then
+// takes what it found as acknowledged: it is on disk now.
+func (m *crashModel) verify(db *KDB, stats *crashStats) error {
+	for i := 0; i < crashKeys; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		var got *string
+		v, ok, err := db.Get(key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if ok {
+			got = &v
+		}
+		if sameValue(got, m.acked[key]) {
+			m.acked[key] = got
+			delete(m.pending, key)
+			continue
+		}
+		found := false
+		for _, p := range m.pending[key] {
+			found = found || sameValue(got, p)
+		}
+		if !found {
+			return fmt.Errorf("%s recovered as %s, last acknowledged %s and %d failed writes since",
+				key, showValue(got), showValue(m.acked[key]), len(m.pending[key]))
+		}
+		stats.survived++
+		m.acked[key] = got
+		delete(m.pending, key)
+	}
+
+	it := db.NewIterator(IterOptions{})
+	defer it.Close()
+	n := 0
+	for ; it.Valid(); it.Next() {
+		if v, ok, err := db.Get(it.Key()); err != nil || !ok || v != it.Value() {
+			return fmt.Errorf("iterator yields %s = %q, Get disagrees", it.Key(), it.Value())
+		}
+		n++
+	}
+	live := 0
+	for _, v := range m.acked {
+		if v != nil {
+			live++
+		}
+	}
+	if n != live {
+		return fmt.Errorf("iterator yields %d keys, expected %d", n, live)
+	}
+	return nil
+}
+
+func sameValue(a, b *string) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func showValue(v *string) string {
+	if v == nil {
+		return "absent"
+	}
+	if len(*v) > 24 {
+		return strconv.Quote((*v)[:24] + "...")
+	}
+	return strconv.Quote(*v)
+}
@@ -1,155 +1,449 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+)
 
+var (
+	// ErrKeyExists is returned by PutIfAbsent when the key already holds a value.
+	ErrKeyExists = errors.New("kdb: key already exists")
+	// ErrKeyNotFound is returned when an operation requires an existing key.
+	ErrKeyNotFound = errors.New("kdb: key not found")
+	// ErrValueMismatch is returned by CompareAndSwap when the current value
+	// differs from the expected one.
+	ErrValueMismatch = errors.New("kdb: current value does not match")
+	// ErrClosed is returned by writes to a DB that has been closed.
+	ErrClosed = errors.New("kdb: closed")
+	// ErrReadOnly is returned by writes to a follower, which only applies
+	// what it replicates from its leader.
+	ErrReadOnly = errors.New("kdb: read-only follower")
+	// ErrLocked is returned by Open when another KDB, in this process or
+	// another, has the directory open, and by tools that would change it.
+	ErrLocked = errors.New("kdb: DB directory is locked")
+)
+
+// KDB is a small LSM-style key/value store. The B-tree rooted at head is
+// the memtable; once it grows past Options.MemtableSize it is flushed to a
+// new numbered SSTable in level 0 and the WAL is truncated. A background
+// goroutine compacts the SSTables according to Options.Compaction.
+//
+// A KDB is safe for concurrent use. Readers share db.mu; writers are
+// serialised by writeMu and only take db.mu exclusively for the moment they
+// change the memtable or the table set.
 type KDB struct {
-	head *Node
-	Size int
+	// writeMu serialises Put, Delete, Write, flushes and Close. It is always
+	// taken before mu.
+	writeMu  sync.Mutex
+	closed   bool
+	readOnly bool // set by StartFollower; see replication.go
+
 	wal  *WAL
-}
+	opts Options
+	dir  string // the DB directory; see manifest.go for its layout
+	lock io.Closer
+
+	// mu guards the memtable, the snapshot bookkeeping and the table set
+	// below, which writers and the compactor swap out from under readers.
+	mu       sync.RWMutex
+	head     *Node
+	Size     int   // number of entries in the memtable, tombstones included
+	memBytes int   // approximate key+value bytes held by the memtable
+	seq      int64 // sequence number of the last applied write
+
+	// oldVersions counts the versions kept below the newest one of each key
+	// for the sake of open snapshots and transactions.
+	oldVersions int
+
+	// memGen numbers memtables; it is bumped on every flush. Snapshots
+	// taken against an older memtable keep it alive in frozenMems until
+	// they are released.
+	memGen     int
+	frozenMems map[int]*Node
+	snapshots  map[*Snapshot]struct{}
+
+	levels         [][]*SSTable // levels[0] oldest first, deeper levels by key
+	nextTable      int
+	compactPointer [maxLevels]string
+
+	// manifest logs every change to the set of live files. logNumber is the
+	// first WAL segment not yet flushed to a table.
+	manifest       *manifestLog
+	logNumber      int
+	orphansRemoved int // files Open deleted as left over or obsolete
+
+	retiredFilterStats FilterStats // counters of tables removed by compaction
+
+	// repl hands every applied write to the followers streaming from this
+	// DB.
+	repl replicationHub
 
-// newKDB creates an in-memory DB without WAL.
-func newKDB() *KDB {
-	return &KDB{}
+	compactCh  chan struct{}
+	compactWG  sync.WaitGroup
+	compactErr error
+
+	// now is the clock expiry times are compared against, in Unix
+	// nanoseconds.
+	now          func() int64
+	stopReap     chan struct{}
+	reapWG       sync.WaitGroup
+	reapStopOnce sync.Once
 }
 
-// newKDBWithWAL creates a DB with WAL and replays existing WAL entries.
-func newKDBWithWAL(walPath string) (*KDB, error) {
-	db := &KDB{}
+// Open opens the DB in dir, creating the directory and an empty DB if
+// needed. It replays the manifest to find the live SSTables and WAL
+// segments, deletes every other file a crash or an obsolete version left
+// behind, and replays the WAL into the memtable.
+func Open(dir string, opts Options) (_ *KDB, err error) {
+	opts = opts.withDefaults()
+	if err := opts.FS.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create DB directory: %w", err)
+	}
+	lock, err := opts.FS.Lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, fmt.Errorf("lock DB directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+	db := &KDB{opts: opts, dir: dir, lock: lock, now: wallClock}
+	for _, c := range []Compression{db.opts.Compression, db.opts.WAL.Compression} {
+		if err := RegisterCompression(c); err != nil {
+			return nil, err
+		}
+	}
+
+	state, err := db.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.removeOrphans(state); err != nil {
+		return nil, err
+	}
+	if err := db.loadTables(state); err != nil {
+		return nil, err
+	}
+	// Start a fresh manifest from what was read, which also replaces the
+	// (possibly torn) tail of the old one.
+	db.manifest = &manifestLog{num: state.num}
+	if err := db.rollManifest(); err != nil {
+		db.closeTables()
+		return nil, err
+	}
 
-	wal, err := NewWAL(walPath)
+	wal, err := NewWAL(filepath.Join(dir, walFile), db.opts.WAL)
 	if err != nil {
+		db.closeManifest()
+		db.closeTables()
 		return nil, fmt.Errorf("failed to create WAL: %w", err)
 	}
 	db.wal = wal
 
 	if err := db.recoverFromWAL(); err != nil {
 		_ = wal.Close()
+		db.closeManifest()
+		db.closeTables()
 		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 	}
+	if err := db.maybeFlush(); err != nil {
+		_ = wal.Close()
+		db.closeManifest()
+		db.closeTables()
+		return nil, err
+	}
+	db.startCompactor()
+	db.startReaper()
 	return db, nil
 }
 
+// Close stops the reaper and background compaction and closes the tables
+// and the WAL. Writes after Close fail with ErrClosed; closing twice is a
+// no-op.
 func (db *KDB) Close() error {
-	if db.wal != nil {
-		return db.wal.Close()
+	db.stopReaper()
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	compactErr := db.stopCompactor()
+	db.mu.Lock()
+	db.closeTables()
+	manifestErr := db.closeManifest()
+	db.mu.Unlock()
+	walErr := db.wal.Close()
+	// The files are closed; another KDB may have them now.
+	db.lock.Close()
+	if walErr != nil {
+		return walErr
+	}
+	if manifestErr != nil {
+		return fmt.Errorf("close manifest: %w", manifestErr)
+	}
+	if compactErr != nil {
+		return fmt.Errorf("background compaction: %w", compactErr)
 	}
 	return nil
 }
 
+// LastSeq returns the sequence number of the last write applied to the DB.
+func (db *KDB) LastSeq() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.seq
+}
+
+// Checkpoint makes the memtable durable outside the WAL by flushing it to
+// an SSTable, which lets the WAL segments it came from be deleted.
 func (db *KDB) Checkpoint() error {
-	if db.wal != nil {
-		return db.wal.Truncate()
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.closed {
+		return ErrClosed
 	}
-	return nil
+	return db.flush()
 }
 
-func (db *KDB) checkIsDuplicateKey(key string) bool {
-	return db.searchKey(db.head, key) != nil
+// Put stores val under key, overwriting any previous value.
+func (db *KDB) Put(key string, val string) error {
+	return db.apply(WALOperation{Operation: opPut, Key: key, Value: val}, nil)
 }
 
-func (db *KDB) searchKey(node *Node, key string) *Node {
-	hash := HashStringToInt(key)
-	if node == nil {
+// PutIfAbsent stores val only if key has no live value, returning
+// ErrKeyExists otherwise.
+func (db *KDB) PutIfAbsent(key string, val string) error {
+	return db.apply(WALOperation{Operation: opPut, Key: key, Value: val}, func() error {
+		_, ok, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return ErrKeyExists
+		}
 		return nil
-	}
+	})
+}
+
+// CompareAndSwap replaces the value of key with newVal only if it currently
+// equals oldVal. It returns ErrKeyNotFound if the key has no live value and
+// ErrValueMismatch if the current value differs.
+func (db *KDB) CompareAndSwap(key string, oldVal, newVal string) error {
+	return db.apply(WALOperation{Operation: opPut, Key: key, Value: newVal}, func() error {
+		cur, ok, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if cur != oldVal {
+			return ErrValueMismatch
+		}
+		return nil
+	})
+}
 
-	if node.size >= 1 && node.key1 == hash {
-		return node
+// apply is the single write path: under writeMu it runs check, if any, logs
+// op to the WAL and applies it to the memtable, flushing when it is full.
+// check sees the DB exactly as op will find it, which is what makes
+// PutIfAbsent and CompareAndSwap atomic.
+//
+// Under group commit the wait for the fsync happens after writeMu is
+// released, so concurrent writers can share it; a concurrent reader may
+// therefore see a write shortly before it is durable.
+func (db *KDB) apply(op WALOperation, check func() error) error {
+	db.writeMu.Lock()
+	if db.closed {
+		db.writeMu.Unlock()
+		return ErrClosed
 	}
-	if node.size >= 2 && node.key2 == hash {
-		return node
+	if db.readOnly {
+		db.writeMu.Unlock()
+		return ErrReadOnly
 	}
-	if node.size >= 3 && node.key3 == hash {
-		return node
+	if check != nil {
+		if err := check(); err != nil {
+			db.writeMu.Unlock()
+			return err
+		}
 	}
 
-	if node.size >= 1 && hash < node.key1 {
-		return db.searchKey(node.cp1, key)
+	wal := db.wal
+	seq, err := db.logAndApply(op)
+	db.writeMu.Unlock()
+	if err != nil {
+		return err
 	}
-	if node.size >= 2 && hash < node.key2 {
-		return db.searchKey(node.cp2, key)
+	return wal.waitDurable(seq)
+}
+
+// logAndApply logs op to the WAL, applies it to the memtable and hands it
+// to the followers, flushing the memtable when it is full. It returns the
+// sequence number op got; the record may not be durable yet. Callers hold
+// db.writeMu.
+func (db *KDB) logAndApply(op WALOperation) (int64, error) {
+	// The WAL hands out sequence numbers; writeMu keeps them in the order
+	// the writes are applied.
+	var err error
+	if op.Seq, err = db.wal.append(op); err != nil {
+		return 0, err
+	}
+
+	db.mu.Lock()
+	db.applyOp(op)
+	db.mu.Unlock()
+	db.repl.publish(op)
+	return op.Seq, db.maybeFlush()
+}
+
+// applyOp stores a PUT, DELETE or BATCH in the memtable under op.Seq.
+// Callers hold db.mu.
+func (db *KDB) applyOp(op WALOperation) {
+	ops := []WALOperation{op}
+	if op.Operation == opBatch {
+		ops = op.Batch
+	}
+	oldest := db.oldestSnapshot()
+	for _, e := range ops {
+		var val *string
+		if e.Operation != opDelete {
+			v := e.Value
+			val = &v
+		}
+		db.set(e.Key, val, e.ExpiresAt, op.Seq, oldest)
+	}
+	db.seq = op.Seq
+}
+
+// set pushes a new version of key, or inserts a new entry. A nil val stores
+// a tombstone; a non-zero expires makes the value expire then. Older
+// versions are kept only while a snapshot at or after oldest may read them.
+// Callers hold db.mu.
+func (db *KDB) set(key string, val *string, expires, seq, oldest int64) {
+	db.memBytes += len(key)
+	if val != nil {
+		db.memBytes += len(*val)
 	}
-	if node.size >= 3 && hash < node.key3 {
-		return db.searchKey(node.cp3, key)
+	v := &version{seq: seq, val: val, expires: expires}
+	if slot := db.valueSlot(key); slot != nil {
+		v.older = *slot
+		*slot = v
+		db.oldVersions += 1 - v.prune(oldest)
+		return
 	}
-	return db.searchKey(node.cp4, key)
+	db.insert(key, v)
 }
 
-func (db *KDB) Put(key string, val string) (bool, string) {
-	hashkey := HashStringToInt(key)
+// Delete removes key from the DB. The entry is kept in the tree as a
+// tombstone (nil value) so that SSTables built afterwards record the
+// deletion instead of silently dropping it.
+func (db *KDB) Delete(key string) error {
+	return db.apply(WALOperation{Operation: opDelete, Key: key}, nil)
+}
 
-	if db.checkIsDuplicateKey(key) {
-		return false, val
+// PurgeTombstones physically removes deleted entries from the tree. Call it
+// once the tombstones have been persisted (e.g. after BuildSSTable). While
+// the DB has SSTables the tombstones still shadow older values in them, and
+// while snapshots are open they may still read what was deleted, so nothing
+// is purged.
+func (db *KDB) PurgeTombstones() int {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.tableCount() > 0 {
+		return 0
 	}
 
-	if db.wal != nil {
-		if err := db.wal.Log("PUT", key, val); err != nil {
-			return false, val
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.snapshots) > 0 {
+		return 0
+	}
+	var dead []string
+	db.forEachEntry(func(key string, v *version) {
+		if v.val == nil {
+			dead = append(dead, key)
 		}
+	})
+	for _, key := range dead {
+		db.remove(key)
 	}
-
-	db.insert(hashkey, &val)
-	return true, val
+	return len(dead)
 }
 
-func (db *KDB) Get(key string) (string, bool) {
-	hash := HashStringToInt(key)
-	node := db.head
+// Get resolves key against the memtable first and then the SSTables from
+// newest to oldest. The first record found wins, so a tombstone or an
+// expired value hides any older value.
+func (db *KDB) Get(key string) (string, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	for node != nil {
-		if node.size >= 1 && node.key1 == hash {
-			if node.rp1 == nil {
-				return "", false
-			}
-			return *node.rp1, true
+	if slot := db.valueSlot(key); slot != nil {
+		v, ok := (*slot).value(db.now())
+		return v, ok, nil
+	}
+	return lookupTables(db.tablesNewestFirst(), key, db.now())
+}
+
+// lookupTables resolves key against tables ordered newest first, treating
+// values expired at now as deleted. A table that cannot be read where key
+// would be, typically with ErrCorruptSSTable, ends the lookup with that
+// error: the newer version or tombstone it may hold must not be skipped in
+// favour of an older value.
+func lookupTables(tables []*SSTable, key string, now int64) (string, bool, error) {
+	for _, t := range tables {
+		if !t.mayContain(key) {
+			continue
 		}
-		if node.size >= 2 && node.key2 == hash {
-			if node.rp2 == nil {
-				return "", false
-			}
-			return *node.rp2, true
+		e, found, err := t.lookup(key)
+		if err != nil {
+			return "", false, fmt.Errorf("read %s: %w", filepath.Base(t.path), err)
 		}
-		if node.size >= 3 && node.key3 == hash {
-			if node.rp3 == nil {
-				return "", false
+		if found {
+			if !e.live(now) {
+				return "", false, nil
 			}
-			return *node.rp3, true
-		}
-
-		if hash < node.key1 {
-			node = node.cp1
-		} else if node.size == 1 || hash < node.key2 {
-			node = node.cp2
-		} else if node.size == 2 || hash < node.key3 {
-			node = node.cp3
-		} else {
-			node = node.cp4
+			return *e.val, true, nil
 		}
 	}
-
-	return "", false
+	return "", false, nil
 }
 
-func (db *KDB) recoverFromWAL() error {
-	if db.wal == nil {
-		return nil
+// liveValue turns a memtable value into Get's result; nil is a tombstone.
+func liveValue(val *string) (string, bool) {
+	if val == nil {
+		return "", false
 	}
+	return *val, true
+}
 
+func (db *KDB) recoverFromWAL() error {
 	ops, err := db.wal.Recover()
 	if err != nil {
 		return err
 	}
 
-	// Disable WAL during replay to avoid re-logging.
-	wal := db.wal
-	db.wal = nil
-	defer func() { db.wal = wal }()
-
+	// Operations are replayed in log order under their logged sequence
+	// numbers, so the last write to each key wins. A batch's checksum has
+	// already vouched for every operation in it, so it is applied whole.
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	for _, op := range ops {
-		switch op.Operation {
-		case "PUT":
-			db.Put(op.Key, op.Value)
+		db.applyOp(op)
+	}
+	// Sequence numbers keep counting from the log, even across truncation.
+	// A snapshot a follower installed can leave the manifest ahead of the
+	// log, which then has to skip ahead too.
+	db.seq = max(db.seq, db.wal.LastSeq())
+	if db.seq > db.wal.LastSeq() {
+		if _, err := db.wal.rotateTo(db.seq); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Parameters of the concurrency stress run.
+const (
+	stressWriters      = 8
+	stressReaders      = 8
+	stressKeysPerOwner = 64
+	stressRounds       = 400
+	stressTxnWorkers   = 4
+	stressIncrements   = 50
+)
+
+// TestConcurrentStress hammers one DB from concurrent writers,
+// transactions, readers, a checkpointer and finally Close, then reopens it
+// and checks every write survived. It is meant to run under the race
+// detector: `go test -race -run ConcurrentStress ./20-db`.
+func TestConcurrentStress(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := Options{
+		MemtableSize: 2 << 10,
+		Compaction:   CompactionLeveled,
+		WAL:          WALOptions{Sync: SyncGroupCommit},
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		failed   atomic.Pointer[error]
+		reads    atomic.Int64
+		writes   atomic.Int64
+		stop     = make(chan struct{})
+		writerWG sync.WaitGroup
+		otherWG  sync.WaitGroup
+	)
+	fail := func(err error) { failed.CompareAndSwap(nil, &err) }
+
+	// Each writer owns its keys, so it knows what their final values must
+	// be. Every round also rewrites a pair of keys in one batch; readers
+	// check through iterators that both halves always agree.
+	models := make([]map[string]*string, stressWriters)
+	for g := 0; g < stressWriters; g++ {
+		models[g] = make(map[string]*string)
+		writerWG.Add(1)
+		go func(g int, model map[string]*string) {
+			defer writerWG.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for round := 0; round < stressRounds; round++ {
+				key := fmt.Sprintf("w%d-%03d", g, rng.Intn(stressKeysPerOwner))
+				val := fmt.Sprintf("%s@%d", key, round)
+				var err error
+				switch rng.Intn(4) {
+				case 0:
+					if err = db.Delete(key); err == nil {
+						model[key] = nil
+					}
+				case 1:
+					cur := model[key]
+					if cur == nil {
+						err = db.PutIfAbsent(key, val)
+					} else {
+						err = db.CompareAndSwap(key, *cur, val)
+					}
+					if err == nil {
+						model[key] = &val
+					}
+				default:
+					if err = db.Put(key, val); err == nil {
+						model[key] = &val
+					}
+				}
+				if err != nil {
+					fail(fmt.Errorf("writer %d: %w", g, err))
+					return
+				}
+
+				var batch WriteBatch
+				pair := fmt.Sprintf("pair%d-", g)
+				batch.Put(pair+"a", val)
+				batch.Put(pair+"b", val)
+				if err := db.Write(&batch); err != nil {
+					fail(fmt.Errorf("writer %d batch: %w", g, err))
+					return
+				}
+				model[pair+"a"], model[pair+"b"] = &val, &val
+				writes.Add(3)
+			}
+		}(g, models[g])
+	}
+
+	// Transactions increment a shared counter; first-committer-wins must
+	// turn every lost race into ErrConflict, never into a lost update.
+	var conflicts atomic.Int64
+	for w := 0; w < stressTxnWorkers; w++ {
+		writerWG.Add(1)
+		go func(w int) {
+			defer writerWG.Done()
+			for i := 0; i < stressIncrements; i++ {
+				for {
+					txn := db.Begin()
+					cur, _, err := txn.Get("counter")
+					if err != nil {
+						fail(fmt.Errorf("txn worker %d: %w", w, err))
+						return
+					}
+					n, _ := strconv.Atoi(cur)
+					_ = txn.Put("counter", strconv.Itoa(n+1))
+					err = txn.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						fail(fmt.Errorf("txn worker %d: %w", w, err))
+						return
+					}
+					conflicts.Add(1)
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < stressReaders; r++ {
+		otherWG.Add(1)
+		go func(r int) {
+			defer otherWG.Done()
+			rng := rand.New(rand.NewSource(int64(100 + r)))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				g := rng.Intn(stressWriters)
+				key := fmt.Sprintf("w%d-%03d", g, rng.Intn(stressKeysPerOwner))
+				v, ok, err := db.Get(key)
+				if err != nil {
+					fail(fmt.Errorf("reader %d: %s: %w", r, key, err))
+					return
+				}
+				if ok && !strings.HasPrefix(v, key+"@") {
+					fail(fmt.Errorf("reader %d: %s holds foreign value %q", r, key, v))
+					return
+				}
+
+				it := db.Prefix(fmt.Sprintf("pair%d-", g))
+				var vals []string
+				for ; it.Valid(); it.Next() {
+					vals = append(vals, it.Value())
+				}
+				_ = it.Close()
+				if len(vals) == 2 && vals[0] != vals[1] {
+					fail(fmt.Errorf("reader %d: torn batch %q", r, vals))
+					return
+				}
+
+				// A snapshot must keep answering the same while writes,
+				// flushes and compactions carry on underneath it.
+				snap := db.Snapshot()
+				before, _, _ := snap.Get(fmt.Sprintf("pair%d-a", g))
+				runtime.Gosched()
+				after, _, _ := snap.Get(fmt.Sprintf("pair%d-a", g))
+				other, _, _ := snap.Get(fmt.Sprintf("pair%d-b", g))
+				snap.Release()
+				if before != after || before != other {
+					fail(fmt.Errorf("reader %d: snapshot %d moved: %q, %q, %q", r, snap.Seq(), before, after, other))
+					return
+				}
+				reads.Add(1)
+				// Give writers a turn; on a single CPU spinning readers would
+				// otherwise get most of the scheduler's time slices.
+				runtime.Gosched()
+			}
+		}(r)
+	}
+
+	otherWG.Add(1)
+	go func() {
+		defer otherWG.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if err := db.Checkpoint(); err != nil && !errors.Is(err, ErrClosed) {
+				fail(fmt.Errorf("checkpoint: %w", err))
+				return
+			}
+		}
+	}()
+
+	writerWG.Wait()
+
+	// Close while readers and the checkpointer are still running, racing a
+	// late writer that must either land or see ErrClosed.
+	late := make(chan error, 1)
+	go func() { late <- db.Put("late", "value") }()
+	if err := db.Close(); err != nil {
+		fail(fmt.Errorf("close: %w", err))
+	}
+	lateErr := <-late
+	if lateErr != nil && !errors.Is(lateErr, ErrClosed) {
+		fail(fmt.Errorf("late put: %w", lateErr))
+	}
+	if err := db.Put("after", "close"); !errors.Is(err, ErrClosed) {
+		fail(fmt.Errorf("put after close returned %v, want ErrClosed", err))
+	}
+	close(stop)
+	otherWG.Wait()
+
+	if errp := failed.Load(); errp != nil {
+		t.Fatal(*errp)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	for _, model := range models {
+		for key, want := range model {
+			got, ok, err := db.Get(key)
+			switch {
+			case err != nil:
+				t.Fatalf("%s after reopen: %v", key, err)
+			case want == nil && ok:
+				t.Fatalf("%s: deleted key reads %q after reopen", key, got)
+			case want != nil && (!ok || got != *want):
+				t.Fatalf("%s: got %q, %v after reopen, want %q", key, got, ok, *want)
+			}
+		}
+	}
+	want := strconv.Itoa(stressTxnWorkers * stressIncrements)
+	if got, _, err := db.Get("counter"); err != nil || got != want {
+		t.Fatalf("counter: got %q, %v after reopen, want %s", got, err, want)
+	}
+	if _, ok, err := db.Get("late"); err != nil || ok != (lateErr == nil) {
+		t.Fatalf("late put: durable=%v (%v) but Put returned %v", ok, err, lateErr)
+	}
+
+	t.Logf("%d writes, %d reads, %d txn conflicts, %d tables after reopen",
+		writes.Load(), reads.Load(), conflicts.Load(), db.tableCount())
+}
+
+// TestOpenLocksDirectory checks a DB directory can only be open once at a
+// time, that tool repair keeps out of an open one, and that a crashed
+// process leaves no lock behind.
+func TestOpenLocksDirectory(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, Options{}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Open returned %v, want ErrLocked", err)
+	}
+	out := toolOutput{w: io.Discard}
+	if err := toolRepair(out, dir, false); !errors.Is(err, ErrLocked) {
+		t.Fatalf("repair of an open DB returned %v, want ErrLocked", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := toolRepair(out, dir, false); err != nil {
+		t.Fatalf("repair of a closed DB: %v", err)
+	}
+	db, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open after Close: %v", err)
+	}
+	db.Close()
+
+	fs := NewFaultFS(1)
+	crashed, err := Open("/kdb", Options{FS: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("/kdb", Options{FS: fs}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second Open on a FaultFS returned %v, want ErrLocked", err)
+	}
+	db, err = Open("/kdb", Options{FS: fs.Crash()})
+	if err != nil {
+		t.Fatalf("Open after a crash: %v", err)
+	}
+	db.Close()
+	_ = crashed.Close() // fails: its file system is gone
+}
+
+// TestToolRepairMatchesRecovery damages a record in the middle of the WAL,
+// which recovery refuses to skip by default, and checks repair cuts the
+// log exactly there: the records before it survive, the ones after are
+// reported dropped and gone, and no sequence number is handed out twice.
+func TestToolRepairMatchesRecovery(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lastSeq := db.LastSeq()
+	segment := db.wal.segmentPath(db.wal.segment)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := OSFS.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := segmentCodec(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offs []int
+	walkRecords(data, codec, func(off, _ int, _ WALOperation, _ error) bool {
+		offs = append(offs, off)
+		return true
+	})
+	data[offs[5]+walRecordHeaderSize] ^= 0xff
+	if err := writeFileSync(OSFS, segment, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, Options{}); !errors.Is(err, ErrWALCorrupt) {
+		t.Fatalf("opened a WAL damaged mid-segment: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := toolRepair(toolOutput{json: true, w: &buf}, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	var r repairReport
+	if err := json.Unmarshal([]byte(buf.String()), &r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Damaged || r.Offset != offs[5] || r.DroppedRecords != 4 || r.NextSeq != lastSeq+1 {
+		t.Fatalf("repair report %+v, want a cut at offset %d dropping 4 records", r, offs[5])
+	}
+
+	db, err = Open(dir, Options{WAL: WALOptions{Recovery: RecoveryStrict}})
+	if err != nil {
+		t.Fatalf("Open after repair: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		_, ok, err := db.Get(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i < 5) {
+			t.Errorf("key%d present %v after repair", i, ok)
+		}
+	}
+	if err := db.Put("after", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if db.LastSeq() <= lastSeq {
+		t.Fatalf("write after repair got seq %d, already used up to %d", db.LastSeq(), lastSeq)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInjected is returned by a FaultFS call that Faults made fail.
+	ErrInjected = errors.New("kdb: injected fault")
+	// ErrCrashed is returned by every FaultFS call once the simulated
+	// process has been killed.
+	ErrCrashed = errors.New("kdb: simulated crash")
+)
+
+// Faults are the failures a FaultFS injects.
+type Faults struct {
+	// WriteErrorRate is the chance that a write fails after writing only a
+	// random part of its data, as on a full disk.
+	WriteErrorRate float64
+	// SyncErrorRate is the chance that syncing a file or directory fails,
+	// leaving it unsynced.
+	SyncErrorRate float64
+	// CrashAfter kills the process at the CrashAfter-th call from now: that
+	// call and every later one fail with ErrCrashed and change nothing.
+	// Zero never kills it.
+	CrashAfter int
+	// TornWrites makes a crash keep a random prefix of the data written to
+	// each file since its last sync, instead of dropping all of it.
+	TornWrites bool
+}
+
+// FaultFS is an in-memory FS that injects Faults and simulates crashes.
+// It keeps apart what reads see from what a crash leaves: the contents of
+// a file as of its last Sync, and the names in a directory as of its last
+// SyncDir. Crash returns the latter.
+type FaultFS struct {
+	mu       sync.Mutex
+	rng      *rand.Rand
+	faults   Faults
+	calls    int
+	crashed  bool
+	injected int
+
+	dirs    map[string]bool
+	files   map[string]*memNode // the names reads see
+	durable map[string]*memNode // the names a crash leaves
+	locks   map[string]bool
+}
+
+// memNode is the content of a file, which several names may share while
+// a rename is not yet synced.
+type memNode struct {
+	data   []byte // what reads see
+	synced []byte // what a crash leaves, at least
+}
+
+// NewFaultFS returns an empty FaultFS without faults whose random choices
+// follow seed.
+func NewFaultFS(seed int64) *FaultFS {
+	return &FaultFS{
+		rng:     rand.New(rand.NewSource(seed)),
+		dirs:    map[string]bool{".": true, "/": true},
+		files:   make(map[string]*memNode),
+		durable: make(map[string]*memNode),
+		locks:   make(map[string]bool),
+	}
+}
+
+// SetFaults replaces the faults to inject; CrashAfter counts from now.
+func (fs *FaultFS) SetFaults(f Faults) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults, fs.calls = f, 0
+}
+
+// Injected returns the number of write and sync failures injected so far.
+func (fs *FaultFS) Injected() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.injected
+}
+
+// Crashed reports whether the simulated process has been killed.
+func (fs *FaultFS) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.crashed
+}
+
+// Crash kills the simulated process and returns the file system a
+// restarted one finds: every name created, renamed or removed since its
+// directory was last synced is back as it was, and every file has lost
+// what was written to it since it was last synced, or with TornWrites a
+// random part of that. The new FaultFS has no faults and no locks held;
+// the old one fails every call from now on.
+func (fs *FaultFS) Crash() *FaultFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = true
+
+	after := NewFaultFS(fs.rng.Int63())
+	for dir := range fs.dirs {
+		after.dirs[dir] = true
+	}
+	nodes := make(map[*memNode]*memNode)
+	names := make([]string, 0, len(fs.durable))
+	for name := range fs.durable {
+		names = append(names, name)
+	}
+	sort.Strings(names) // keeps the tearing reproducible
+	for _, name := range names {
+		n := fs.durable[name]
+		c, ok := nodes[n]
+		if !ok {
+			data := bytes.Clone(n.synced)
+			if fs.faults.TornWrites && len(n.data) > len(n.synced) && bytes.HasPrefix(n.data, n.synced) {
+				data = bytes.Clone(n.data[:len(n.synced)+fs.rng.Intn(len(n.data)-len(n.synced)+1)])
+			}
+			c = &memNode{data: data, synced: bytes.Clone(data)}
+			nodes[n] = c
+		}
+		after.files[name] = c
+		after.durable[name] = c
+	}
+	return after
+}
+
+// call accounts for one call, failing it if the process is dead or dies
+// now. Callers hold fs.mu.
+func (fs *FaultFS) call() error {
+	if fs.crashed {
+		return ErrCrashed
+	}
+	fs.calls++
+	if fs.faults.CrashAfter > 0 && fs.calls >= fs.faults.CrashAfter {
+		fs.crashed = true
+		return ErrCrashed
+	}
+	return nil
+}
+
+// inject decides whether a call fails with the given rate. Callers hold
+// fs.mu.
+func (fs *FaultFS) inject(rate float64) bool {
+	if rate > 0 && fs.rng.Float64() < rate {
+		fs.injected++
+		return true
+	}
+	return false
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	n, ok := fs.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok:
+		if !fs.dirs[filepath.Dir(name)] {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		n = &memNode{}
+		fs.files[name] = n
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.data = n.data[:0:0]
+	}
+	return &memFile{fs: fs, node: n, name: name, flag: flag}, nil
+}
+
+func (fs *FaultFS) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return nil, err
+	}
+	n, ok := fs.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return bytes.Clone(n.data), nil
+}
+
+func (fs *FaultFS) ReadDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return nil, err
+	}
+	dir = filepath.Clean(dir)
+	if !fs.dirs[dir] {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	var names []string
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for d := range fs.dirs {
+		if d != dir && filepath.Dir(d) == dir {
+			names = append(names, filepath.Base(d))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (fs *FaultFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return err
+	}
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = n
+	return nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return err
+	}
+	name = filepath.Clean(name)
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+// MkdirAll creates dir and its parents. Directories are durable at once.
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return err
+	}
+	for d := filepath.Clean(dir); !fs.dirs[d]; d = filepath.Dir(d) {
+		fs.dirs[d] = true
+	}
+	return nil
+}
+
+func (fs *FaultFS) SyncDir(dir string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return err
+	}
+	if fs.inject(fs.faults.SyncErrorRate) {
+		return &os.PathError{Op: "sync", Path: dir, Err: ErrInjected}
+	}
+	dir = filepath.Clean(dir)
+	for name := range fs.durable {
+		if filepath.Dir(name) == dir {
+			delete(fs.durable, name)
+		}
+	}
+	for name, n := range fs.files {
+		if filepath.Dir(name) == dir {
+			fs.durable[name] = n
+		}
+	}
+	return nil
+}
+
+// Lock locks name in memory only; no lock file is created.
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.call(); err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	if fs.locks[name] {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+// memLock is a lock held on a FaultFS.
+type memLock struct {
+	fs       *FaultFS
+	name     string
+	released bool
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if !l.released {
+		l.released = true
+		delete(l.fs.locks, l.name)
+	}
+	return nil
+}
+
+// memFile is an open FaultFS file.
+type memFile struct {
+	fs     *FaultFS
+	node   *memNode
+	name   string
+	flag   int
+	off    int64
+	closed bool
+}
+
+// check accounts for a call on f. Callers hold f.fs.mu.
+func (f *memFile) check() error {
+	if err := f.fs.call(); err != nil {
+		return err
+	}
+	if f.closed {
+		return &os.PathError{Op: "use", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 || f.flag&os.O_APPEND != 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrPermission}
+	}
+	return f.writeAt(p, off)
+}
+
+// writeAt writes p at off, or with a write fault only a random prefix of
+// it. Callers hold f.fs.mu.
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	var err error
+	if f.fs.inject(f.fs.faults.WriteErrorRate) {
+		p = p[:f.fs.rng.Intn(len(p)+1)]
+		err = &os.PathError{Op: "write", Path: f.name, Err: ErrInjected}
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	return len(p), err
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	if f.fs.inject(f.fs.faults.SyncErrorRate) {
+		return &os.PathError{Op: "sync", Path: f.name, Err: ErrInjected}
+	}
+	f.node.synced = bytes.Clone(f.node.data)
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data))}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check(); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
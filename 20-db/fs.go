@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// FS is the file system a KDB keeps its directory on. Everything the WAL,
+// the SSTables and the manifest read or write goes through it, so a test
+// can swap the disk for a FaultFS and see what a crash leaves behind.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	ReadFile(name string) ([]byte, error)
+	// ReadDir returns the names of the entries of dir in sorted order.
+	ReadDir(dir string) ([]string, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	// SyncDir makes the files created, renamed and removed in dir so far
+	// survive a crash. Syncing a file only covers its contents.
+	SyncDir(dir string) error
+	// Lock takes an exclusive lock on the file name, creating it, until
+	// the returned Closer is closed or the process dies. It fails with
+	// ErrLocked while someone else holds the lock.
+	Lock(name string) (io.Closer, error)
+}
+
+// File is an open file of an FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// OSFS is the FS of the operating system, which a KDB uses unless
+// Options.FS says otherwise.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) ReadDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// statFile returns the FileInfo of name, a file or a directory, in fs.
+func statFile(fs FS, name string) (os.FileInfo, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
@@ -0,0 +1,52 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// heldLocks are the lock files this process holds. Without flock(2) only
+// this process is kept out of a locked directory.
+var heldLocks = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	if heldLocks.names[path] {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	heldLocks.names[path] = true
+	return &heldLock{f: f, path: path}, nil
+}
+
+type heldLock struct {
+	f    *os.File
+	path string
+	once sync.Once
+}
+
+func (l *heldLock) Close() error {
+	var err error
+	l.once.Do(func() {
+		heldLocks.Lock()
+		delete(heldLocks.names, l.path)
+		heldLocks.Unlock()
+		err = l.f.Close()
+	})
+	return err
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Iterator walks key/value pairs in key order. A fresh iterator is already
+// positioned on its first entry; check Valid before reading Key or Value.
+// Callers may stop at any point and must call Close when done.
+//
+// Both KDB and SSTable hand out iterators through this interface, so the
+// same scanning code works against either source.
+type Iterator interface {
+	// Seek moves to the first key >= key, or, for a reverse iterator, to the
+	// last key <= key. Keys outside the iterator's range are never visited.
+	Seek(key string)
+	// Next advances to the following entry in iteration order.
+	Next()
+	// Valid reports whether the iterator is positioned on an entry.
+	Valid() bool
+	Key() string
+	Value() string
+	// Close releases the iterator and reports any error hit while reading.
+	Close() error
+}
+
+// IterOptions bounds an iteration. Start is inclusive and End is exclusive;
+// an empty End means "no upper bound". Reverse walks from the largest key
+// down to the smallest.
+type IterOptions struct {
+	Start   string
+	End     string
+	Reverse bool
+}
+
+// contains reports whether key falls inside the [Start, End) range.
+func (o IterOptions) contains(key string) bool {
+	return key >= o.Start && (o.End == "" || key < o.End)
+}
+
+// prefixEnd returns the smallest key greater than every key with prefix p,
+// or "" when no such key exists (p is empty or all 0xff bytes).
+func prefixEnd(p string) string {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// kvEntry is one record handed to an iterator. A nil val is a tombstone.
+type kvEntry struct {
+	key     string
+	val     *string
+	seq     int64 // sequence number of the write, 0 if unknown
+	expires int64 // Unix nanoseconds when val expires, 0 for never
+}
+
+// recordIterator is one source of a mergingIterator. It yields raw
+// records, tombstones included, in iteration order, and stops early if it
+// fails to read them.
+type recordIterator interface {
+	seek(key string)
+	next()
+	valid() bool
+	entry() kvEntry
+	err() error
+}
+
+// sliceIterator iterates over entries that were collected up front, already
+// sorted ascending by key. readErr is set if collecting them failed part
+// way, after the last entry.
+type sliceIterator struct {
+	entries []kvEntry
+	reverse bool
+	pos     int
+	readErr error
+}
+
+func newSliceIterator(entries []kvEntry, reverse bool) *sliceIterator {
+	it := &sliceIterator{entries: entries, reverse: reverse}
+	if reverse {
+		it.pos = len(entries) - 1
+	}
+	return it
+}
+
+func (it *sliceIterator) seek(key string) {
+	// Index of the first entry >= key.
+	i := sort.Search(len(it.entries), func(i int) bool { return it.entries[i].key >= key })
+	if it.reverse && (i == len(it.entries) || it.entries[i].key != key) {
+		i--
+	}
+	it.pos = i
+}
+
+func (it *sliceIterator) next() {
+	if it.reverse {
+		it.pos--
+	} else {
+		it.pos++
+	}
+}
+
+func (it *sliceIterator) valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) entry() kvEntry {
+	return it.entries[it.pos]
+}
+
+// err reports readErr once the iterator reaches the point where collecting
+// failed: the end going forward, the very start in reverse.
+func (it *sliceIterator) err() error {
+	if it.reverse || !it.valid() {
+		return it.readErr
+	}
+	return nil
+}
+
+// memBatch is how many memtable entries a memIterator copies at a time.
+const memBatch = 64
+
+// memIterator walks the memtable a snapshot reads within opts, copying
+// memBatch entries at a time under db.mu. The snapshot keeps the versions
+// it sees, and the memtable itself once frozen, from being reclaimed in
+// between.
+type memIterator struct {
+	snap  *Snapshot
+	opts  IterOptions
+	batch []kvEntry
+	pos   int
+	more  bool // whether the memtable may hold entries past the batch
+}
+
+func newMemIterator(snap *Snapshot, opts IterOptions) *memIterator {
+	it := &memIterator{snap: snap, opts: opts}
+	it.fill(opts)
+	return it
+}
+
+// fill copies the first memBatch entries within r in iteration order, r
+// lying within the iterator's own range.
+func (it *memIterator) fill(r IterOptions) {
+	db := it.snap.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	it.batch, it.pos = it.batch[:0], 0
+	it.more = !db.walkRange(it.snap.memRoot(), r, it.snap.seq, it.opts.Reverse, func(e kvEntry) bool {
+		it.batch = append(it.batch, e)
+		return len(it.batch) < memBatch
+	})
+}
+
+func (it *memIterator) seek(key string) {
+	r := it.opts
+	switch {
+	case !r.Reverse:
+		r.Start = max(key, r.Start)
+	case r.End == "" || key < r.End:
+		// Keys <= key are the keys < key+"\x00".
+		r.End = key + "\x00"
+	}
+	it.fill(r)
+}
+
+func (it *memIterator) next() {
+	it.pos++
+	if it.pos < len(it.batch) || !it.more {
+		return
+	}
+	last, r := it.batch[len(it.batch)-1].key, it.opts
+	if r.Reverse {
+		r.End = last
+	} else {
+		r.Start = last + "\x00"
+	}
+	it.fill(r)
+}
+
+func (it *memIterator) valid() bool {
+	return it.pos < len(it.batch)
+}
+
+func (it *memIterator) entry() kvEntry {
+	return it.batch[it.pos]
+}
+
+func (it *memIterator) err() error {
+	return nil
+}
+
+// tableIterator walks the records of a table within opts, holding one data
+// block in memory at a time.
+type tableIterator struct {
+	t       *SSTable
+	opts    IterOptions
+	block   int       // index of the block in entries
+	entries []kvEntry // records of that block
+	pos     int       // position in entries; out of range when not valid
+	readErr error
+}
+
+// newTableIterator returns an iterator positioned on the first record of t
+// within opts, or the last one if opts.Reverse is set.
+func newTableIterator(t *SSTable, opts IterOptions) *tableIterator {
+	it := &tableIterator{t: t, opts: opts}
+	switch {
+	case !opts.Reverse:
+		it.seek(opts.Start)
+	case opts.End != "":
+		it.seek(opts.End)
+	default:
+		it.seekLast(len(t.blocks)-1, func(string) bool { return false })
+	}
+	return it
+}
+
+func (it *tableIterator) seek(key string) {
+	if !it.opts.Reverse {
+		key = max(key, it.opts.Start)
+		if it.load(it.t.findBlock(key)) {
+			// One before the first record >= key, for next to step onto
+			// it or on to the following block.
+			it.pos = sort.Search(len(it.entries), func(i int) bool { return it.entries[i].key >= key }) - 1
+			it.next()
+		}
+		return
+	}
+	if it.opts.End != "" && key >= it.opts.End {
+		end := it.opts.End
+		it.seekLast(it.t.findBlock(end), func(k string) bool { return k >= end })
+		return
+	}
+	it.seekLast(it.t.findBlock(key), func(k string) bool { return k > key })
+}
+
+// seekLast positions a reverse iterator on the last record of block b, or
+// of an earlier block, that is not past the bound.
+func (it *tableIterator) seekLast(b int, past func(key string) bool) {
+	if !it.load(min(b, len(it.t.blocks)-1)) {
+		return
+	}
+	// One past the last record within the bound, for next to step back
+	// onto it or on to the previous block.
+	it.pos = sort.Search(len(it.entries), func(i int) bool { return past(it.entries[i].key) })
+	it.next()
+}
+
+// load reads block b into entries, reporting whether there is such a block
+// and it could be read.
+func (it *tableIterator) load(b int) bool {
+	it.block, it.entries, it.pos = b, nil, -1
+	if b < 0 || b >= len(it.t.blocks) || it.readErr != nil {
+		return false
+	}
+	entries, err := it.t.readBlock(b)
+	if err != nil {
+		it.readErr = fmt.Errorf("read sstable %s: %w", it.t.path, err)
+		return false
+	}
+	it.entries = entries
+	return true
+}
+
+func (it *tableIterator) next() {
+	if it.opts.Reverse {
+		it.pos--
+		for it.pos < 0 && it.load(it.block-1) {
+			it.pos = len(it.entries) - 1
+		}
+		if it.valid() && it.entries[it.pos].key < it.opts.Start {
+			it.pos = -1
+		}
+		return
+	}
+	it.pos++
+	for it.pos >= len(it.entries) && it.load(it.block+1) {
+		it.pos = 0
+	}
+	if it.valid() && it.opts.End != "" && it.entries[it.pos].key >= it.opts.End {
+		it.pos = len(it.entries)
+	}
+}
+
+func (it *tableIterator) valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *tableIterator) entry() kvEntry {
+	return it.entries[it.pos]
+}
+
+func (it *tableIterator) err() error {
+	return it.readErr
+}
+
+// mergingIterator merges record sources ordered newest first into an
+// Iterator over the keys live at now: for each key the newest record wins,
+// and a tombstone or an expired value hides the key. A source that fails
+// to read ends the iteration, and Close reports its error.
+type mergingIterator struct {
+	sources []recordIterator
+	reverse bool
+	now     int64
+	cur     kvEntry
+	ok      bool
+	readErr error
+	release func() // unpins the tables the sources read; run by Close
+	// raw keeps the keys a tombstone or an expired value hides; entry
+	// then yields their newest record.
+	raw bool
+}
+
+func newMergingIterator(sources []recordIterator, reverse bool, now int64, release func()) *mergingIterator {
+	it := &mergingIterator{sources: sources, reverse: reverse, now: now, release: release}
+	it.settle()
+	return it
+}
+
+// newRecordMerger merges sources, ordered newest first, into the newest
+// record of every key, tombstones and expired values included, as
+// compaction needs them.
+func newRecordMerger(sources []recordIterator) *mergingIterator {
+	it := &mergingIterator{sources: sources, raw: true}
+	it.settle()
+	return it
+}
+
+// settle positions the iterator on the first live key the sources are at
+// or past, skipping hidden ones unless raw.
+func (it *mergingIterator) settle() {
+	it.ok = false
+	for {
+		best := -1
+		for i, src := range it.sources {
+			if err := src.err(); err != nil {
+				it.readErr = err
+				return
+			}
+			if !src.valid() {
+				continue
+			}
+			if best == -1 || it.before(src.entry().key, it.sources[best].entry().key) {
+				best = i
+			}
+		}
+		if best == -1 {
+			return
+		}
+		e := it.sources[best].entry()
+		if it.raw || e.live(it.now) {
+			it.cur, it.ok = e, true
+			return
+		}
+		it.skip(e.key)
+	}
+}
+
+// before reports whether a comes before b in iteration order.
+func (it *mergingIterator) before(a, b string) bool {
+	if it.reverse {
+		return a > b
+	}
+	return a < b
+}
+
+// skip moves every source positioned on key past it.
+func (it *mergingIterator) skip(key string) {
+	for _, src := range it.sources {
+		if src.valid() && src.entry().key == key {
+			src.next()
+		}
+	}
+}
+
+func (it *mergingIterator) Seek(key string) {
+	if it.readErr != nil {
+		return
+	}
+	for _, src := range it.sources {
+		src.seek(key)
+	}
+	it.settle()
+}
+
+func (it *mergingIterator) Next() {
+	if !it.ok {
+		return
+	}
+	it.skip(it.cur.key)
+	it.settle()
+}
+
+func (it *mergingIterator) Valid() bool {
+	return it.ok
+}
+
+func (it *mergingIterator) Key() string {
+	return it.cur.key
+}
+
+func (it *mergingIterator) Value() string {
+	return *it.cur.val
+}
+
+// entry returns the record the iterator is at.
+func (it *mergingIterator) entry() kvEntry {
+	return it.cur
+}
+
+func (it *mergingIterator) Close() error {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	it.sources, it.ok = nil, false
+	return it.readErr
+}
+
+// NewIterator returns an iterator over the live keys of the DB within opts.
+// The memtable and every SSTable are merged, newest record per key winning.
+// The iterator reads through a snapshot it releases on Close, so it sees the
+// DB as it was when created and holds no lock in between: it copies the
+// memtable a batch of entries at a time and reads tables a block at a time.
+func (db *KDB) NewIterator(opts IterOptions) Iterator {
+	snap := db.Snapshot()
+	it := snap.newIterator(opts, db.now())
+	it.release = snap.Release
+	return it
+}
+
+// Range returns a forward iterator over keys in [start, end).
+func (db *KDB) Range(start, end string) Iterator {
+	return db.NewIterator(IterOptions{Start: start, End: end})
+}
+
+// Prefix returns a forward iterator over keys starting with p.
+func (db *KDB) Prefix(p string) Iterator {
+	return db.NewIterator(IterOptions{Start: p, End: prefixEnd(p)})
+}
+
+// walkRange is forEachEntry restricted to opts and to the versions visible
+// at seq, skipping subtrees that lie entirely outside the range. It walks
+// in descending order if reverse is set, and stops early, returning false,
+// once fn does.
+func (db *KDB) walkRange(node *Node, opts IterOptions, seq int64, reverse bool, fn func(e kvEntry) bool) bool {
+	if node == nil {
+		return true
+	}
+	keys, vals, kids := db.unpackNode(node)
+	visitChild := func(i int) bool {
+		// Child i holds the keys between keys[i-1] and keys[i].
+		if kids != nil &&
+			(i == len(keys) || keys[i] > opts.Start) &&
+			(i == 0 || opts.End == "" || keys[i-1] < opts.End) {
+			return db.walkRange(kids[i], opts, seq, reverse, fn)
+		}
+		return true
+	}
+	visitKey := func(i int) bool {
+		if opts.contains(keys[i]) {
+			if v := vals[i].at(seq); v != nil {
+				return fn(kvEntry{key: keys[i], val: v.val, seq: v.seq, expires: v.expires})
+			}
+		}
+		return true
+	}
+	if reverse {
+		for i := len(keys); i >= 0; i-- {
+			if (i < len(keys) && !visitKey(i)) || !visitChild(i) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i <= len(keys); i++ {
+		if !visitChild(i) || (i < len(keys) && !visitKey(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewIterator returns an iterator over the live keys of the table within
+// opts, reading one block at a time.
+func (s *SSTable) NewIterator(opts IterOptions) Iterator {
+	return newMergingIterator([]recordIterator{newTableIterator(s, opts)}, opts.Reverse, wallClock(), nil)
+}
+
+// Range returns a forward iterator over keys in [start, end).
+func (s *SSTable) Range(start, end string) Iterator {
+	return s.NewIterator(IterOptions{Start: start, End: end})
+}
+
+// Prefix returns a forward iterator over keys starting with p.
+func (s *SSTable) Prefix(p string) Iterator {
+	return s.NewIterator(IterOptions{Start: p, End: prefixEnd(p)})
+}
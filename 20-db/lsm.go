@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// defaultMemtableSize is the flush threshold used when Options leaves it unset.
+const defaultMemtableSize = 4 << 20
+
+// Options tunes a KDB opened with Open.
+type Options struct {
+	// MemtableSize is the approximate number of key+value bytes the
+	// memtable may hold before it is flushed to a new SSTable.
+	MemtableSize int
+
+	// Compaction selects how SSTables are merged in the background.
+	Compaction CompactionStrategy
+	// MinMergeWidth is the number of similar-sized tables size-tiered
+	// compaction waits for before merging them.
+	MinMergeWidth int
+	// L0CompactionTrigger is the number of level-0 tables that makes
+	// leveled compaction push them down into level 1.
+	L0CompactionTrigger int
+	// BaseLevelSize is the byte budget of level 1 under leveled compaction;
+	// every deeper level gets LevelSizeMultiplier times more.
+	BaseLevelSize       int64
+	LevelSizeMultiplier int
+	// TargetFileSize is the size at which leveled compaction starts a new
+	// output table.
+	TargetFileSize int64
+
+	// BlockSize is the size at which SSTable writers close a data block.
+	BlockSize int
+	// BloomBitsPerKey sizes the Bloom filter written into each SSTable.
+	// Zero picks the default; a negative value writes no filter.
+	BloomBitsPerKey int
+	// Compression compresses SSTable data blocks, and WAL records unless
+	// WAL.Compression says otherwise. Nil stores them uncompressed. Files
+	// written with an earlier setting stay readable.
+	Compression Compression
+
+	// WAL tunes segment rotation, the fsync policy and how damaged records
+	// are recovered.
+	WAL WALOptions
+
+	// FS is the file system the DB directory lives on, and the WAL's and
+	// the page file's unless WAL.FS or Paged.FS say otherwise. Nil means
+	// OSFS.
+	FS FS
+
+	// ReapInterval is how often expired values are dropped from the
+	// memtable. A negative value disables the background reaper.
+	ReapInterval time.Duration
+
+	// Backend selects the storage engine openBackend opens; Paged tunes the
+	// paged one. The fields above only apply to the LSM backend.
+	Backend BackendKind
+	Paged   PagedOptions
+}
+
+func (o Options) withDefaults() Options {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = defaultMemtableSize
+	}
+	if o.MinMergeWidth <= 1 {
+		o.MinMergeWidth = 4
+	}
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = 4
+	}
+	if o.BaseLevelSize <= 0 {
+		o.BaseLevelSize = 10 * int64(o.MemtableSize)
+	}
+	if o.LevelSizeMultiplier <= 1 {
+		o.LevelSizeMultiplier = 10
+	}
+	if o.TargetFileSize <= 0 {
+		o.TargetFileSize = int64(o.MemtableSize)
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = defaultBlockSize
+	}
+	if o.BloomBitsPerKey == 0 {
+		o.BloomBitsPerKey = defaultBloomBitsPerKey
+	}
+	if o.Compression == nil {
+		o.Compression = NoCompression
+	}
+	if o.WAL.Compression == nil {
+		o.WAL.Compression = o.Compression
+	}
+	if o.FS == nil {
+		o.FS = OSFS
+	}
+	if o.WAL.FS == nil {
+		o.WAL.FS = o.FS
+	}
+	if o.Paged.FS == nil {
+		o.Paged.FS = o.FS
+	}
+	if o.ReapInterval == 0 {
+		o.ReapInterval = defaultReapInterval
+	}
+	return o
+}
+
+// loadTables opens the SSTables the manifest lists.
+func (db *KDB) loadTables(s *manifestState) error {
+	db.levels = make([][]*SSTable, maxLevels)
+	for level, nums := range s.levels {
+		for _, num := range nums {
+			t, err := loadSSTable(db.opts.FS, db.tablePath(num))
+			if err != nil {
+				db.closeTables()
+				return err
+			}
+			t.num, t.level = num, level
+			db.levels[level] = append(db.levels[level], t)
+		}
+		if level > 0 {
+			tables := db.levels[level]
+			sort.Slice(tables, func(i, j int) bool { return tables[i].minKey < tables[j].minKey })
+		}
+	}
+	db.nextTable = s.nextTable
+	db.logNumber = s.logNumber
+	db.seq = s.lastSeq
+	return nil
+}
+
+// closeTables drops the table set's reference to every table. Tables that
+// open snapshots still hold stay readable until those are released.
+func (db *KDB) closeTables() {
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+	}
+	db.levels = nil
+}
+
+// tablesNewestFirst returns every table in the order reads must consult
+// them: level 0 from newest to oldest, then each deeper level. Callers hold
+// db.mu.
+func (db *KDB) tablesNewestFirst() []*SSTable {
+	var out []*SSTable
+	for level, tables := range db.levels {
+		if level == 0 {
+			for i := len(tables) - 1; i >= 0; i-- {
+				out = append(out, tables[i])
+			}
+			continue
+		}
+		out = append(out, tables...)
+	}
+	return out
+}
+
+// tableCount returns the number of live SSTables.
+func (db *KDB) tableCount() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	n := 0
+	for _, tables := range db.levels {
+		n += len(tables)
+	}
+	return n
+}
+
+// FilterStats sums the Bloom filter counters of every SSTable the DB has
+// consulted, including tables that have since been compacted away.
+func (db *KDB) FilterStats() FilterStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	stats := db.retiredFilterStats
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			stats = stats.add(t.FilterStats())
+		}
+	}
+	return stats
+}
+
+// maybeFlush flushes the memtable once it exceeds the configured size.
+// Callers hold db.writeMu.
+func (db *KDB) maybeFlush() error {
+	if db.memBytes <= db.opts.MemtableSize {
+		return nil
+	}
+	return db.flush()
+}
+
+// flush writes the memtable, tombstones included, to the next numbered
+// SSTable in level 0 and starts an empty memtable. The WAL moves on to a
+// new segment first, and one manifest edit then both adds the table and
+// marks the older segments obsolete, so after a crash either the table is
+// live and those segments are deleted, or the table is an orphan and they
+// are replayed.
+//
+// Callers hold db.writeMu, so the memtable cannot change while the table is
+// built and readers only need db.mu for the final swap.
+func (db *KDB) flush() error {
+	if db.Size == 0 {
+		return nil
+	}
+
+	db.mu.Lock()
+	db.nextTable++
+	num := db.nextTable
+	db.mu.Unlock()
+
+	t, err := BuildSSTable(db, db.tablePath(num))
+	if err != nil {
+		return fmt.Errorf("flush memtable: %w", err)
+	}
+	t.num = num
+	segment, err := db.wal.Rotate()
+	if err != nil {
+		t.unref() // an orphan now; Open deletes it
+		return fmt.Errorf("flush memtable: %w", err)
+	}
+
+	// Installing the table and emptying the memtable happen under one lock,
+	// so readers see each key in exactly one of them.
+	db.mu.Lock()
+	db.levels[0] = append(db.levels[0], t)
+	prevLog := db.logNumber
+	db.logNumber = segment
+	err = db.logEdit(versionEdit{
+		LogNumber: segment,
+		NextTable: db.nextTable,
+		Added:     []manifestTable{{Num: num, Level: 0, Pos: len(db.levels[0]) - 1}},
+	})
+	if err != nil {
+		db.levels[0] = db.levels[0][:len(db.levels[0])-1]
+		db.logNumber = prevLog
+	} else {
+		db.resetMemtable()
+	}
+	db.mu.Unlock()
+	if err != nil {
+		t.unref()
+		return fmt.Errorf("flush memtable: %w", err)
+	}
+
+	if err := db.wal.RemoveSegmentsBefore(segment); err != nil {
+		return fmt.Errorf("remove flushed WAL segments: %w", err)
+	}
+
+	db.scheduleCompaction()
+	return nil
+}
+
+// resetMemtable starts an empty memtable. Snapshots still reading the old
+// one keep it frozen. Callers hold db.mu.
+func (db *KDB) resetMemtable() {
+	if db.memGenInUse(db.memGen) {
+		if db.frozenMems == nil {
+			db.frozenMems = make(map[int]*Node)
+		}
+		db.frozenMems[db.memGen] = db.head
+	}
+	db.memGen++
+	db.head = nil
+	db.Size = 0
+	db.memBytes = 0
+	db.oldVersions = 0
+}
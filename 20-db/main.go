@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -10,67 +12,234 @@ import (
 // To run the demo, run the whole package (not just this single file):
 //   - from repo root: `go run ./20-db`
 //   - or from this folder: `go run .`
+//
+// Subcommands run a server or a tool instead of the demo:
+//   - `go run ./20-db serve [addr] [dir]` serves a DB over the Redis protocol (try redis-cli -p 6380)
+//   - `go run ./20-db follow <leader> [addr] [dir]` serves a read-only replica of a serving DB
+//   - `go run ./20-db backup <dir> <backup dir>` and `restore <backup dir> <dir>` back up and restore a DB
+//   - `go run ./20-db tool <wal|verify|stats|tree|repair> [-json] <dir>` inspects and repairs the files of a closed DB
 
 func main() {
-	walPath := "kdb.wal"
-	db, err := newKDBWithWAL(walPath)
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "serve":
+			err = runServer(os.Args[2:])
+		case "follow":
+			err = runFollower(os.Args[2:])
+		case "backup":
+			err = runBackup(os.Args[2:])
+		case "restore":
+			err = runRestore(os.Args[2:])
+		case "tool":
+			err = runTool(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			fmt.Printf("%s failed: %v\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// A tiny memtable so the demo spills into several SSTables, which the
+	// background compactor then merges.
+	db, err := Open("kdb-data", Options{MemtableSize: 128, Compaction: CompactionLeveled})
 	if err != nil {
 		fmt.Printf("Failed to create database: %v\n", err)
 		return
 	}
 	defer db.Close()
 
-	if db.Size == 0 {
+	if _, ok, _ := db.Get("user1"); !ok {
 		fmt.Println("-------------- Inserting 50 records ------------")
 		insertStart := time.Now()
 
 		for i := 1; i <= 50; i++ {
 			key := fmt.Sprintf("user%d", i)
 			val := fmt.Sprintf("value-%d", i)
-			_, _ = db.Put(key, val)
+			if err := db.Put(key, val); err != nil {
+				fmt.Printf("Put error: %v\n", err)
+			}
 		}
 
 		fmt.Printf("Insert time elapsed: %v\n", time.Since(insertStart))
 	} else {
-		fmt.Printf("Database recovered with %d entries from WAL\n", db.Size)
+		fmt.Printf("Database recovered with %d SSTables and %d memtable entries from WAL\n", db.tableCount(), db.Size)
+	}
+	if db.orphansRemoved > 0 {
+		fmt.Printf("Removed %d orphaned files\n", db.orphansRemoved)
+	}
+	if r := db.wal.RecoveryReport(); r.TruncatedBytes > 0 || r.CorruptRecords > 0 {
+		fmt.Printf("WAL recovery: truncated %d torn bytes, skipped %d corrupt records\n", r.TruncatedBytes, r.CorruptRecords)
 	}
 
-	fmt.Println("-------------- Tree Stats ------------")
-	fmt.Printf("Total entries: %d\n", db.Size)
+	fmt.Println("-------------- LSM Stats ------------")
+	fmt.Printf("Memtable entries: %d\n", db.Size)
+	db.mu.RLock()
+	for level, tables := range db.levels {
+		for _, t := range tables {
+			fmt.Printf("L%d SSTable: %s [%q .. %q] %d bytes\n", level, t.path, t.minKey, t.maxKey, t.size)
+		}
+	}
+	db.mu.RUnlock()
 
-	db.PrintTree()
+	fmt.Println("-------------- Updating user3 ------------")
+	// The snapshot keeps seeing user3 and user2 as they are now, whatever
+	// the updates below do.
+	snap := db.Snapshot()
+	defer snap.Release()
+	if err := db.PutIfAbsent("user3", "other"); errors.Is(err, ErrKeyExists) {
+		fmt.Println("PutIfAbsent user3: already exists")
+	}
+	if err := db.CompareAndSwap("user3", "value-3", "value-3-v2"); err == nil {
+		fmt.Println("CompareAndSwap user3: value-3 -> value-3-v2")
+	} else if errors.Is(err, ErrValueMismatch) {
+		v, _, _ := db.Get("user3")
+		fmt.Printf("CompareAndSwap user3: current value is %q\n", v)
+	}
 
-	// Build an SSTable snapshot of current data
-	fmt.Println("-------------- Building SSTable ------------")
-	sst, err := BuildSSTable(db, "kdb.sst")
-	if err != nil {
-		fmt.Printf("SSTable build error: %v\n", err)
-	} else {
-		defer sst.Close()
-		fmt.Println("SSTable built at kdb.sst")
+	fmt.Println("-------------- Deleting user2 ------------")
+	if err := db.Delete("user2"); err != nil {
+		fmt.Printf("Delete error: %v\n", err)
+	}
+	if _, ok, _ := db.Get("user2"); !ok {
+		fmt.Println("user2: deleted")
+	}
+	if v, ok, _ := snap.Get("user2"); ok {
+		fmt.Printf("user2 in snapshot %d: %s\n", snap.Seq(), v)
+	}
+	if v, ok, _ := snap.Get("user3"); ok {
+		fmt.Printf("user3 in snapshot %d: %s\n", snap.Seq(), v)
+	}
+
+	fmt.Println("-------------- Batch transfer ------------")
+	// Move user4's value to user51 in one atomic batch: a crash can never
+	// leave both keys or neither holding it.
+	if v, ok, _ := db.Get("user4"); ok {
+		var batch WriteBatch
+		batch.Delete("user4")
+		batch.Put("user51", v)
+		if err := db.Write(&batch); err != nil {
+			fmt.Printf("Write error: %v\n", err)
+		}
+	}
+	if v, ok, _ := db.Get("user51"); ok {
+		fmt.Printf("user51: %s\n", v)
+	}
+
+	fmt.Println("-------------- Transactions ------------")
+	// Both transactions read user5 and write it back; the second to commit
+	// loses and must retry.
+	t1, t2 := db.Begin(), db.Begin()
+	for i, txn := range []*Txn{t1, t2} {
+		v, _, _ := txn.Get("user5")
+		_ = txn.Put("user5", fmt.Sprintf("%s+t%d", v, i+1))
+	}
+	fmt.Printf("commit t1: %v\n", t1.Commit())
+	if err := t2.Commit(); errors.Is(err, ErrConflict) {
+		fmt.Printf("commit t2: %v\n", err)
+	}
+	if v, ok, _ := db.Get("user5"); ok {
+		fmt.Printf("user5: %s\n", v)
+	}
+
+	fmt.Println("-------------- TTL ------------")
+	// session expires after 50ms; once it has, Get treats it as deleted.
+	if err := db.PutWithTTL("session", "token-123", 50*time.Millisecond); err != nil {
+		fmt.Printf("PutWithTTL error: %v\n", err)
+	}
+	if v, ok, _ := db.Get("session"); ok {
+		fmt.Printf("session: %s\n", v)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok, _ := db.Get("session"); !ok {
+		fmt.Println("session: expired")
 	}
 
+	fmt.Println("-------------- Typed values ------------")
+	type profile struct {
+		Name  string
+		Posts int
+	}
+	profiles := NewTyped[profile](db, JSONCodec[profile]{})
+	if err := profiles.Put("profile:user1", profile{Name: "Ada", Posts: 3}); err != nil {
+		fmt.Printf("Put error: %v\n", err)
+	}
+	if p, ok, err := profiles.Get("profile:user1"); ok && err == nil {
+		fmt.Printf("profile:user1: %+v\n", p)
+	}
+	_ = db.PutBytes("blob", []byte{0x00, 0xff, 0x10})
+	if b, ok, _ := db.GetBytes("blob"); ok {
+		fmt.Printf("blob: % x\n", b)
+	}
+
+	db.PrintTree()
+
 	fmt.Println("-------------- Fetching data ------------")
 	getStart := time.Now()
-	if v, ok := db.Get("user1"); ok {
+	if v, ok, _ := db.Get("user1"); ok {
 		fmt.Printf("user1: %s\n", v)
 	}
-	if v, ok := db.Get("user50"); ok {
+	if v, ok, _ := db.Get("user50"); ok {
 		fmt.Printf("user50: %s\n", v)
 	}
 	fmt.Printf("Get time elapsed: %v\n", time.Since(getStart))
 
-	// Read back via SSTable (if built)
-	if err == nil && sst != nil {
-		fmt.Println("-------------- SSTable lookups ------------")
-		if v, ok := sst.Get("user1"); ok {
-			fmt.Printf("sst user1: %s\n", v)
-		}
-		if v, ok := sst.Get("user50"); ok {
-			fmt.Printf("sst user50: %s\n", v)
-		}
-		if _, ok := sst.Get("missing"); !ok {
-			fmt.Println("sst missing: not found")
+	// user1 was flushed long ago, while the user2 tombstone may still sit in
+	// the memtable; Get must resolve both correctly.
+	fmt.Println("-------------- Memtable + SSTable lookups ------------")
+	if v, ok, _ := db.Get("user1"); ok {
+		fmt.Printf("user1: %s\n", v)
+	}
+	if _, ok, _ := db.Get("user2"); !ok {
+		fmt.Println("user2: deleted (tombstone shadows older SSTable value)")
+	}
+	if _, ok, _ := db.Get("missing"); !ok {
+		fmt.Println("missing: not found")
+	}
+	stats := db.FilterStats()
+	fmt.Printf("Bloom filters: %d checks, %.0f%% skipped, %.1f%% false positives\n",
+		stats.Checks, 100*stats.HitRate(), 100*stats.FalsePositiveRate())
+
+	fmt.Println("-------------- Range scans ------------")
+	it := db.Prefix("user4")
+	for ; it.Valid(); it.Next() {
+		fmt.Printf("prefix user4: %s -> %s\n", it.Key(), it.Value())
+	}
+	_ = it.Close()
+
+	// Walk backwards from user3 and stop after three keys.
+	rev := db.NewIterator(IterOptions{Reverse: true})
+	rev.Seek("user3")
+	for n := 0; rev.Valid() && n < 3; rev.Next() {
+		fmt.Printf("reverse from user3: %s\n", rev.Key())
+		n++
+	}
+	_ = rev.Close()
+
+	fmt.Println("-------------- Paged B+ tree backend ------------")
+	// The same data through the Backend interface, this time stored in place
+	// in a page file. Small pages and fanout make the tree a few levels deep.
+	paged, err := openBackend("kdb-paged", Options{Backend: BackendPaged, Paged: PagedOptions{PageSize: 512, Fanout: 8}})
+	if err != nil {
+		fmt.Printf("Failed to open paged backend: %v\n", err)
+		return
+	}
+	defer paged.Close()
+	for i := 1; i <= 50; i++ {
+		if err := paged.Put(fmt.Sprintf("user%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			fmt.Printf("Put error: %v\n", err)
 		}
 	}
+	_ = paged.Delete("user2")
+	if v, ok, _ := paged.Get("user3"); ok {
+		fmt.Printf("paged user3: %s\n", v)
+	}
+	pit := paged.NewIterator(IterOptions{Start: "user1", End: "user13"})
+	for ; pit.Valid(); pit.Next() {
+		fmt.Printf("paged range: %s -> %s\n", pit.Key(), pit.Value())
+	}
+	_ = pit.Close()
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A DB directory holds
+//
+//	LOCK              locked by the process that has the DB open
+//	CURRENT           name of the live manifest
+//	MANIFEST-000003   log of edits to the set of live files
+//	000012.sst        SSTables
+//	wal.000007        WAL segments
+//
+// New files are written under a .tmp name and only get their real name,
+// by an atomic rename, once they are complete and synced. A file the
+// manifest does not list is therefore either left over from a crash or
+// already obsolete, and Open deletes it.
+const (
+	lockFile       = "LOCK"
+	currentFile    = "CURRENT"
+	manifestPrefix = "MANIFEST-"
+	walFile        = "wal"
+	tmpSuffix      = ".tmp"
+
+	// manifestRollSize is the size past which the manifest is rewritten as
+	// a single edit describing the current file set.
+	manifestRollSize = 1 << 20
+)
+
+// ErrManifestCorrupt is returned when CURRENT or the manifest cannot be
+// read back.
+var ErrManifestCorrupt = errors.New("kdb: corrupt manifest")
+
+// versionEdit is one record of the manifest: a change to the set of live
+// files. Zero fields leave the corresponding state unchanged.
+type versionEdit struct {
+	// LogNumber is the first WAL segment whose records are not yet in an
+	// SSTable; older segments are obsolete.
+	LogNumber int `json:"log_number,omitempty"`
+	NextTable int `json:"next_table,omitempty"`
+	// LastSeq is a sequence number the DB has reached, for when the tables
+	// hold writes the WAL never saw: a follower's installed snapshot.
+	LastSeq int64           `json:"last_seq,omitempty"`
+	Deleted []int           `json:"deleted,omitempty"`
+	Added   []manifestTable `json:"added,omitempty"`
+}
+
+type manifestTable struct {
+	Num   int `json:"num"`
+	Level int `json:"level"`
+	// Pos is where a level-0 table goes in level 0, counted after the
+	// edit's deletions. Deeper levels are kept in key order instead.
+	Pos int `json:"pos,omitempty"`
+}
+
+// manifestState is the file set obtained by replaying a manifest.
+type manifestState struct {
+	num       int // number of the manifest file it was read from
+	logNumber int
+	nextTable int
+	lastSeq   int64
+	levels    [maxLevels][]int // table numbers, level 0 in read order
+}
+
+func (s *manifestState) apply(e versionEdit) error {
+	s.logNumber = max(s.logNumber, e.LogNumber)
+	s.nextTable = max(s.nextTable, e.NextTable)
+	s.lastSeq = max(s.lastSeq, e.LastSeq)
+	for _, num := range e.Deleted {
+		for level, nums := range s.levels {
+			s.levels[level] = slices.DeleteFunc(nums, func(n int) bool { return n == num })
+		}
+	}
+	for _, t := range e.Added {
+		if t.Level < 0 || t.Level >= maxLevels {
+			return fmt.Errorf("%w: table %d in level %d", ErrManifestCorrupt, t.Num, t.Level)
+		}
+		if t.Level == 0 {
+			pos := min(max(t.Pos, 0), len(s.levels[0]))
+			s.levels[0] = slices.Insert(s.levels[0], pos, t.Num)
+			continue
+		}
+		s.levels[t.Level] = append(s.levels[t.Level], t.Num)
+	}
+	return nil
+}
+
+// live reports whether table num is part of the file set.
+func (s *manifestState) live(num int) bool {
+	for _, nums := range s.levels {
+		if slices.Contains(nums, num) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestLog is the open manifest that edits are appended to.
+type manifestLog struct {
+	file   File
+	num    int
+	size   int64
+	broken bool // an append failed; the next edit must roll the manifest
+}
+
+func (db *KDB) tablePath(n int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d.sst", n))
+}
+
+func (db *KDB) manifestPath(n int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%s%06d", manifestPrefix, n))
+}
+
+// readManifest replays the manifest named by CURRENT. A directory without
+// CURRENT holds a new DB and yields an empty state.
+//
+// Each manifest record is
+//
+//	crc:4 | length:4 | edit (JSON)
+//
+// with the CRC32 covering the edit. A torn or corrupt record ends the log:
+// an edit is only relied on once its append has been synced, so whatever
+// follows a damaged record was never committed.
+func (db *KDB) readManifest() (*manifestState, error) {
+	current, err := db.opts.FS.ReadFile(filepath.Join(db.dir, currentFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &manifestState{}, nil
+		}
+		return nil, fmt.Errorf("read CURRENT: %w", err)
+	}
+	name := strings.TrimSpace(string(current))
+	num, err := strconv.Atoi(strings.TrimPrefix(name, manifestPrefix))
+	if err != nil || !strings.HasPrefix(name, manifestPrefix) {
+		return nil, fmt.Errorf("%w: CURRENT names %q", ErrManifestCorrupt, name)
+	}
+	data, err := db.opts.FS.ReadFile(db.manifestPath(num))
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	s := &manifestState{num: num}
+	for len(data) >= 8 {
+		n := binary.LittleEndian.Uint32(data[4:])
+		if uint64(n) > uint64(len(data)-8) {
+			break
+		}
+		payload := data[8 : 8+n]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data) {
+			break
+		}
+		var e versionEdit
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrManifestCorrupt, err)
+		}
+		if err := s.apply(e); err != nil {
+			return nil, err
+		}
+		data = data[8+n:]
+	}
+	return s, nil
+}
+
+// logEdit appends e to the manifest and syncs it; once this returns the
+// edit survives a crash. Callers hold db.mu and have already applied e to
+// the table set, which they undo if logEdit fails.
+func (db *KDB) logEdit(e versionEdit) error {
+	m := db.manifest
+	if !m.broken {
+		err := m.append(e)
+		if err == nil {
+			if m.size > manifestRollSize {
+				// e is already durable; if the roll fails the manifest
+				// just keeps growing until the next attempt.
+				_ = db.rollManifest()
+			}
+			return nil
+		}
+		m.broken = true
+	}
+	// A failed append may have left a partial record, and nothing after it
+	// would be read back. Start over from the table set, e included.
+	return db.rollManifest()
+}
+
+// append writes e as the next record and syncs the file.
+func (m *manifestLog) append(e versionEdit) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal manifest edit: %w", err)
+	}
+	record := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(record[0:], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(payload)))
+	record = append(record, payload...)
+
+	if _, err := m.file.Write(record); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("sync manifest: %w", err)
+	}
+	m.size += int64(len(record))
+	return nil
+}
+
+// rollManifest starts a new manifest holding a single edit that describes
+// the current file set, points CURRENT at it and deletes the old one.
+// Callers hold db.mu, or have the DB to themselves during Open, when
+// db.manifest only names the manifest that was read and has no file open.
+func (db *KDB) rollManifest() error {
+	snapshot := versionEdit{LogNumber: db.logNumber, NextTable: db.nextTable, LastSeq: db.seq}
+	for level, tables := range db.levels {
+		for i, t := range tables {
+			snapshot.Added = append(snapshot.Added, manifestTable{Num: t.num, Level: level, Pos: i})
+		}
+	}
+
+	old := db.manifest
+	num := old.num + 1
+	f, err := db.opts.FS.OpenFile(db.manifestPath(num), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("create manifest: %w", err)
+	}
+	m := &manifestLog{file: f, num: num}
+	if err := m.append(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+
+	// Until CURRENT is renamed into place a crash keeps using the old
+	// manifest, and the new one is an orphan.
+	tmp := filepath.Join(db.dir, currentFile+tmpSuffix)
+	err = writeFileSync(db.opts.FS, tmp, []byte(fmt.Sprintf("%s%06d\n", manifestPrefix, num)))
+	if err == nil {
+		err = installFile(db.opts.FS, tmp, filepath.Join(db.dir, currentFile))
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("install manifest: %w", err)
+	}
+	db.manifest = m
+	if old.file != nil {
+		old.file.Close()
+	}
+	_ = db.opts.FS.Remove(db.manifestPath(old.num))
+	return nil
+}
+
+// closeManifest closes the manifest file. Callers hold db.mu.
+func (db *KDB) closeManifest() error {
+	if db.manifest == nil || db.manifest.file == nil {
+		return nil
+	}
+	err := db.manifest.file.Close()
+	db.manifest = nil
+	return err
+}
+
+// removeOrphans deletes every file in the DB directory that s does not
+// keep alive: unfinished .tmp files, tables no longer listed, WAL segments
+// already flushed to tables and old manifests. Unknown files are left
+// alone.
+func (db *KDB) removeOrphans(s *manifestState) error {
+	names, err := db.opts.FS.ReadDir(db.dir)
+	if err != nil {
+		return fmt.Errorf("list DB directory: %w", err)
+	}
+	for _, name := range names {
+		var orphan bool
+		switch {
+		case strings.HasSuffix(name, tmpSuffix):
+			orphan = true
+		case strings.HasSuffix(name, ".sst"):
+			num, err := strconv.Atoi(strings.TrimSuffix(name, ".sst"))
+			orphan = err == nil && !s.live(num)
+		case strings.HasPrefix(name, walFile+"."):
+			num, err := strconv.Atoi(strings.TrimPrefix(name, walFile+"."))
+			orphan = err == nil && num < s.logNumber
+		case strings.HasPrefix(name, manifestPrefix):
+			num, err := strconv.Atoi(strings.TrimPrefix(name, manifestPrefix))
+			orphan = err == nil && num != s.num
+		}
+		if !orphan {
+			continue
+		}
+		if err := db.opts.FS.Remove(filepath.Join(db.dir, name)); err != nil {
+			return fmt.Errorf("remove orphan %s: %w", name, err)
+		}
+		db.orphansRemoved++
+	}
+	return nil
+}
+
+// writeFileSync writes data to path on fs and syncs it.
+func writeFileSync(fs FS, path string, data []byte) error {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installFile atomically renames the complete file tmp to path and syncs
+// the directory so the new name survives a crash.
+func installFile(fs FS, tmp, path string) error {
+	if err := fs.Rename(tmp, path); err != nil {
+		return fmt.Errorf("install %s: %w", filepath.Base(path), err)
+	}
+	return syncDir(fs, filepath.Dir(path))
+}
+
+func syncDir(fs FS, dir string) error {
+	if err := fs.SyncDir(dir); err != nil {
+		return fmt.Errorf("sync directory: %w", err)
+	}
+	return nil
+}
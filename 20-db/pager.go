@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"golangdsa/20-db/bufferpool"
+)
+
+// A page file is an array of fixed-size pages. Page 0 holds the file
+// header; every other page is a B+ tree node or sits on the free list.
+// Each page starts with
+//
+//	crc:4 | type:1
+//
+// where the CRC32 covers the rest of the page. The header page continues
+//
+//	magic:4 | version:2 | pageSize:4 | fanout:4 | root:4 | freeHead:4 | pageCount:4
+//
+// and a free page with the id of the next free page (0 ends the list).
+// All integers are little endian.
+const (
+	pageMagic   uint32 = 0x4b425054 // "KBPT"
+	pageVersion uint16 = 1
+
+	pageTypeHeader   byte = 1
+	pageTypeLeaf     byte = 2
+	pageTypeInternal byte = 3
+	pageTypeFree     byte = 4
+
+	pageHeaderSize = 5 // crc + type
+	minPageSize    = 512
+)
+
+// ErrCorruptPage is returned when a page fails its checksum or does not
+// hold what the tree expects.
+var ErrCorruptPage = errors.New("kdb: corrupt page")
+
+// pager reads and writes the pages of a page file and hands out free pages.
+// Pages are cached in a buffer pool, which writes modified pages back when it
+// evicts them or on sync; the pager is the pool's DiskManager and checks and
+// stamps CRCs as pages move between the pool and the file. It is not safe
+// for concurrent writes; the tree serialises them.
+type pager struct {
+	file      File
+	pool      *bufferpool.Pool
+	pageSize  int
+	fanout    int
+	root      uint32
+	freeHead  uint32 // first page of the free list, 0 if empty
+	pageCount uint32 // pages in the file, header included
+}
+
+// pagerLRUK is the K of the buffer pool's LRU-K eviction.
+const pagerLRUK = 2
+
+// openPager opens or creates the page file at path on fs, caching up to
+// cachePages pages. A new file gets pageSize and fanout; an existing one
+// keeps the values it was created with.
+func openPager(fs FS, path string, pageSize, fanout, cachePages int) (*pager, error) {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open page file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat page file: %w", err)
+	}
+
+	p := &pager{file: f, pageSize: pageSize, fanout: fanout}
+	if info.Size() == 0 {
+		// The header page has to exist on disk before the pool can fetch
+		// it, and the new file's name has to survive a crash.
+		p.pageCount = 1
+		err = p.WritePage(0, p.encodeHeader())
+		if err == nil {
+			err = f.Sync()
+		}
+		if err == nil {
+			err = syncDir(fs, filepath.Dir(path))
+		}
+	} else {
+		err = p.readHeader()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.pool = bufferpool.New(p, p.pageSize, cachePages, pagerLRUK)
+	return p, nil
+}
+
+func (p *pager) readHeader() error {
+	// The page size is only known once the header has been read, and the
+	// header fits in the smallest page size allowed.
+	buf := make([]byte, minPageSize)
+	if _, err := p.file.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("read page file header: %w", err)
+	}
+	h := buf[pageHeaderSize:]
+	if buf[4] != pageTypeHeader || binary.LittleEndian.Uint32(h[0:]) != pageMagic {
+		return fmt.Errorf("%w: bad page file header", ErrCorruptPage)
+	}
+	if v := binary.LittleEndian.Uint16(h[4:]); v != pageVersion {
+		return fmt.Errorf("unsupported page file version %d", v)
+	}
+	p.pageSize = int(binary.LittleEndian.Uint32(h[6:]))
+	if p.pageSize < minPageSize {
+		return fmt.Errorf("%w: bad page size %d", ErrCorruptPage, p.pageSize)
+	}
+
+	page := make([]byte, p.pageSize)
+	if err := p.ReadPage(0, page); err != nil {
+		return err
+	}
+	h = page[pageHeaderSize:]
+	p.fanout = int(binary.LittleEndian.Uint32(h[10:]))
+	p.root = binary.LittleEndian.Uint32(h[14:])
+	p.freeHead = binary.LittleEndian.Uint32(h[18:])
+	p.pageCount = binary.LittleEndian.Uint32(h[22:])
+	return nil
+}
+
+// writeHeader persists the root, free list and page count.
+func (p *pager) writeHeader() error {
+	return p.write(0, p.encodeHeader())
+}
+
+func (p *pager) encodeHeader() []byte {
+	page := make([]byte, p.pageSize)
+	page[4] = pageTypeHeader
+	h := page[pageHeaderSize:]
+	binary.LittleEndian.PutUint32(h[0:], pageMagic)
+	binary.LittleEndian.PutUint16(h[4:], pageVersion)
+	binary.LittleEndian.PutUint32(h[6:], uint32(p.pageSize))
+	binary.LittleEndian.PutUint32(h[10:], uint32(p.fanout))
+	binary.LittleEndian.PutUint32(h[14:], p.root)
+	binary.LittleEndian.PutUint32(h[18:], p.freeHead)
+	binary.LittleEndian.PutUint32(h[22:], p.pageCount)
+	return page
+}
+
+// read returns a copy of page id.
+func (p *pager) read(id uint32) ([]byte, error) {
+	if id >= p.pageCount {
+		return nil, fmt.Errorf("%w: page %d out of range", ErrCorruptPage, id)
+	}
+	pg, err := p.pool.FetchPage(bufferpool.PageID(id))
+	if err != nil {
+		return nil, err
+	}
+	page := bytes.Clone(pg.Data())
+	return page, p.pool.UnpinPage(pg.ID(), false)
+}
+
+// write replaces the contents of page id with page.
+func (p *pager) write(id uint32, page []byte) error {
+	pg, err := p.pool.FetchPage(bufferpool.PageID(id))
+	if err != nil {
+		return err
+	}
+	copy(pg.Data(), page)
+	return p.pool.UnpinPage(pg.ID(), true)
+}
+
+// ReadPage reads page id from the file into buf and checks its CRC. It is
+// called by the buffer pool on a miss.
+func (p *pager) ReadPage(id bufferpool.PageID, buf []byte) error {
+	if _, err := p.file.ReadAt(buf, int64(id)*int64(p.pageSize)); err != nil {
+		return fmt.Errorf("read page %d: %w", id, err)
+	}
+	if crc32.ChecksumIEEE(buf[4:]) != binary.LittleEndian.Uint32(buf) {
+		return fmt.Errorf("%w: page %d checksum mismatch", ErrCorruptPage, id)
+	}
+	return nil
+}
+
+// WritePage stamps the CRC into buf and writes it to slot id. It is called
+// by the buffer pool to write back dirty pages.
+func (p *pager) WritePage(id bufferpool.PageID, buf []byte) error {
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	if _, err := p.file.WriteAt(buf, int64(id)*int64(p.pageSize)); err != nil {
+		return fmt.Errorf("write page %d: %w", id, err)
+	}
+	return nil
+}
+
+// AllocatePage grows the file by one page. It is called by the buffer pool
+// for NewPage.
+func (p *pager) AllocatePage() (bufferpool.PageID, error) {
+	id := p.pageCount
+	p.pageCount++
+	return bufferpool.PageID(id), nil
+}
+
+// allocate returns a page to use, reusing the free list before growing the
+// file.
+func (p *pager) allocate() (uint32, error) {
+	if p.freeHead == 0 {
+		pg, err := p.pool.NewPage()
+		if err != nil {
+			return 0, err
+		}
+		return uint32(pg.ID()), p.pool.UnpinPage(pg.ID(), true)
+	}
+	id := p.freeHead
+	page, err := p.read(id)
+	if err != nil {
+		return 0, err
+	}
+	if page[4] != pageTypeFree {
+		return 0, fmt.Errorf("%w: page %d on the free list is in use", ErrCorruptPage, id)
+	}
+	p.freeHead = binary.LittleEndian.Uint32(page[pageHeaderSize:])
+	return id, nil
+}
+
+// free puts page id on the free list.
+func (p *pager) free(id uint32) error {
+	page := make([]byte, p.pageSize)
+	page[4] = pageTypeFree
+	binary.LittleEndian.PutUint32(page[pageHeaderSize:], p.freeHead)
+	if err := p.write(id, page); err != nil {
+		return err
+	}
+	p.freeHead = id
+	return nil
+}
+
+// sync writes back every cached dirty page and flushes the file to stable
+// storage.
+func (p *pager) sync() error {
+	if err := p.pool.FlushAll(); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return fmt.Errorf("sync page file: %w", err)
+	}
+	return nil
+}
+
+func (p *pager) close() error {
+	return p.file.Close()
+}
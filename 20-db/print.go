@@ -4,6 +4,8 @@ import "fmt"
 
 func (db *KDB) PrintTree() {
 	fmt.Println("-------------- Tree Structure ------------")
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	if db.head == nil {
 		fmt.Println("(empty tree)")
 		return
@@ -24,25 +26,25 @@ func (db *KDB) printNode(node *Node, level int, position string) {
 	fmt.Printf("%s[%s] Node (size=%d):\n", indent, position, node.size)
 
 	if node.size >= 1 {
-		val := "<nil>"
-		if node.rp1 != nil {
-			val = *node.rp1
+		val := "<tombstone>"
+		if node.rp1.val != nil {
+			val = *node.rp1.val
 		}
-		fmt.Printf("%s  key1: %d -> \"%s\"\n", indent, node.key1, val)
+		fmt.Printf("%s  key1: %q -> \"%s\"\n", indent, node.key1, val)
 	}
 	if node.size >= 2 {
-		val := "<nil>"
-		if node.rp2 != nil {
-			val = *node.rp2
+		val := "<tombstone>"
+		if node.rp2.val != nil {
+			val = *node.rp2.val
 		}
-		fmt.Printf("%s  key2: %d -> \"%s\"\n", indent, node.key2, val)
+		fmt.Printf("%s  key2: %q -> \"%s\"\n", indent, node.key2, val)
 	}
 	if node.size >= 3 {
-		val := "<nil>"
-		if node.rp3 != nil {
-			val = *node.rp3
+		val := "<tombstone>"
+		if node.rp3.val != nil {
+			val = *node.rp3.val
 		}
-		fmt.Printf("%s  key3: %d -> \"%s\"\n", indent, node.key3, val)
+		fmt.Printf("%s  key3: %q -> \"%s\"\n", indent, node.key3, val)
 	}
 
 	if node.cp1 != nil {
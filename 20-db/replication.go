@@ -0,0 +1,622 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golangdsa/20-db/resp"
+)
+
+// Replication ships the leader's WAL records to followers in sequence
+// order. A follower connects to the leader's server port and sends
+//
+//	SYNC <seq>
+//
+// with the sequence number of the last record it applied. The connection
+// then carries a stream of RESP arrays from the leader:
+//
+//	OP <record>              one WAL record, encoded as in the WAL file
+//	SNAPSHOT <seq> <count>   followed by count [key, value, expires] arrays
+//	PING <seq>               heartbeat with the leader's last sequence number
+//
+// Records the leader still has in its WAL are sent one by one. If the
+// follower is further behind than that, because the segments it needs were
+// flushed to SSTables and deleted, the leader sends a snapshot of every live
+// key, in key order, instead and continues with the records after it. The
+// follower logs each record in its own WAL under the leader's sequence
+// number, so after a disconnect or a restart it resumes exactly where it
+// stopped. A snapshot is streamed into an SSTable that then replaces the
+// follower's tables, so neither side holds it in memory.
+const (
+	replHeartbeat   = time.Second
+	replReadTimeout = 5 * replHeartbeat
+	replMaxBackoff  = 2 * time.Second
+
+	// replSubscriberBuffer is how many records a streaming follower may
+	// lag behind the leader's writes before it is switched back to reading
+	// them from the WAL files.
+	replSubscriberBuffer = 1024
+)
+
+// replicationHub fans the writes applied to a DB out to the followers
+// streaming from it. The zero value is ready to use.
+type replicationHub struct {
+	mu   sync.Mutex
+	subs map[chan WALOperation]struct{}
+}
+
+// subscribe returns a channel that receives every write applied from now
+// on. The hub closes it if the reader falls replSubscriberBuffer writes
+// behind.
+func (h *replicationHub) subscribe() chan WALOperation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan WALOperation]struct{})
+	}
+	ch := make(chan WALOperation, replSubscriberBuffer)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *replicationHub) unsubscribe(ch chan WALOperation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish hands op to every subscriber without blocking the writer. Callers
+// hold db.writeMu, so subscribers see writes in sequence order.
+func (h *replicationHub) publish(op WALOperation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	if op.Timestamp == 0 {
+		op.Timestamp = time.Now().UnixNano()
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- op:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// resync drops every subscriber, which sends each follower back to the
+// WAL files to find where it stands. Records published from now on may
+// not follow the ones it was sent.
+func (h *replicationHub) resync() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// followers returns the number of followers currently streaming.
+func (h *replicationHub) followers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// replicate streams the DB to a follower that has applied every record up
+// to after, until the connection fails or the server shuts down.
+func (s *Server) replicate(w *resp.Writer, after int64) error {
+	db := s.db
+	if last := db.LastSeq(); after > last {
+		w.WriteError(fmt.Sprintf("ERR follower at seq %d is ahead of the leader at %d", after, last))
+		return w.Flush()
+	}
+
+	heartbeat := time.NewTicker(replHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		// Subscribe before reading the WAL: a write either made it into
+		// the files already or is published to ch afterwards. Records seen
+		// both ways are skipped by sequence number.
+		ch := db.repl.subscribe()
+		ops, complete, err := db.wal.Since(after)
+		if err == nil && !complete {
+			after, err = sendSnapshot(w, db)
+			ops = nil
+		}
+		for _, op := range ops {
+			if op.Seq > after && err == nil {
+				err = sendRecord(w, op)
+				after = op.Seq
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			db.repl.unsubscribe(ch)
+			return err
+		}
+
+	stream:
+		for {
+			select {
+			case op, ok := <-ch:
+				if !ok {
+					// Fell behind; catch up from the WAL files again.
+					break stream
+				}
+				if op.Seq <= after {
+					continue
+				}
+				err = sendRecord(w, op)
+				after = op.Seq
+				if err == nil && len(ch) == 0 {
+					err = w.Flush()
+				}
+			case <-heartbeat.C:
+				w.WriteCommand("PING", strconv.FormatInt(db.LastSeq(), 10))
+				err = w.Flush()
+			case <-s.quit:
+				db.repl.unsubscribe(ch)
+				return nil
+			}
+			if err != nil {
+				db.repl.unsubscribe(ch)
+				return err
+			}
+		}
+	}
+}
+
+func sendRecord(w *resp.Writer, op WALOperation) error {
+	rec, err := encodeWALRecord(op, NoCompression)
+	if err != nil {
+		return err
+	}
+	w.WriteArrayHeader(2)
+	w.WriteBulk("OP")
+	w.WriteBulk(string(rec))
+	return nil
+}
+
+// sendSnapshot streams every live key of a fresh snapshot and returns the
+// snapshot's sequence number. The keys are read twice, once to count them
+// for the header and once to send them, so the snapshot is never held in
+// memory.
+func sendSnapshot(w *resp.Writer, db *KDB) (int64, error) {
+	snap := db.Snapshot()
+	defer snap.Release()
+	now := db.now() // both passes must agree on what has expired
+
+	count := 0
+	it := snap.newIterator(IterOptions{}, now)
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	if err := it.Close(); err != nil {
+		return 0, err
+	}
+
+	w.WriteCommand("SNAPSHOT", strconv.FormatInt(snap.Seq(), 10), strconv.Itoa(count))
+	it = snap.newIterator(IterOptions{}, now)
+	for ; it.Valid(); it.Next() {
+		w.WriteCommand(it.cur.key, *it.cur.val, strconv.FormatInt(it.cur.expires, 10))
+	}
+	return snap.Seq(), it.Close()
+}
+
+// ReplicationStatus describes how far a follower has got.
+type ReplicationStatus struct {
+	Leader     string
+	Connected  bool
+	AppliedSeq int64 // last record applied locally
+	LeaderSeq  int64 // last record the leader is known to have
+	// Lag is how old the newest applied record is, measured on the leader's
+	// clock, while the follower is behind; zero once it has caught up.
+	Lag         time.Duration
+	Reconnects  int
+	Snapshots   int // full resyncs received
+	LastError   string
+	LastContact time.Time
+}
+
+// LagRecords is the number of records the follower is known to be behind.
+func (s ReplicationStatus) LagRecords() int64 {
+	return max(s.LeaderSeq-s.AppliedSeq, 0)
+}
+
+// Follower keeps a KDB in sync with a leader's. While it runs the DB is
+// read-only: its writes fail with ErrReadOnly, and only records replicated
+// from the leader are applied.
+type Follower struct {
+	db     *KDB
+	leader string
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu         sync.Mutex
+	conn       net.Conn
+	status     ReplicationStatus
+	appliedAt  int64 // leader timestamp of the newest applied record
+	stopCalled bool
+}
+
+// StartFollower makes db a follower of the server at leader and starts
+// replicating in the background, reconnecting with backoff whenever the
+// connection drops.
+func StartFollower(db *KDB, leader string) *Follower {
+	db.writeMu.Lock()
+	db.readOnly = true
+	db.writeMu.Unlock()
+
+	f := &Follower{
+		db:     db,
+		leader: leader,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: ReplicationStatus{Leader: leader},
+	}
+	go f.run()
+	return f
+}
+
+// Stop disconnects from the leader and waits for replication to stop. The
+// DB stays read-only.
+func (f *Follower) Stop() {
+	f.mu.Lock()
+	if f.stopCalled {
+		f.mu.Unlock()
+		<-f.done
+		return
+	}
+	f.stopCalled = true
+	close(f.stop)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.mu.Unlock()
+	<-f.done
+}
+
+// Status reports the follower's progress.
+func (f *Follower) Status() ReplicationStatus {
+	applied := f.db.LastSeq()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.status
+	st.AppliedSeq = applied
+	st.LeaderSeq = max(st.LeaderSeq, applied)
+	if applied < st.LeaderSeq && f.appliedAt != 0 {
+		st.Lag = time.Since(time.Unix(0, f.appliedAt))
+	}
+	return st
+}
+
+func (f *Follower) run() {
+	defer close(f.done)
+	backoff := 50 * time.Millisecond
+	for {
+		err := f.session()
+		f.mu.Lock()
+		f.status.Connected = false
+		f.conn = nil
+		if err != nil {
+			f.status.LastError = err.Error()
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, replMaxBackoff)
+		f.mu.Lock()
+		f.status.Reconnects++
+		f.mu.Unlock()
+	}
+}
+
+// session connects to the leader and applies what it streams until the
+// connection fails.
+func (f *Follower) session() error {
+	conn, err := net.DialTimeout("tcp", f.leader, replReadTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	f.mu.Lock()
+	if f.stopCalled {
+		f.mu.Unlock()
+		return nil
+	}
+	f.conn = conn
+	f.mu.Unlock()
+
+	w := resp.NewWriter(conn)
+	w.WriteCommand("SYNC", strconv.FormatInt(f.db.LastSeq(), 10))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	r := resp.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replReadTimeout))
+		v, err := r.ReadValue()
+		if err != nil {
+			return err
+		}
+		if err := v.Err(); err != nil {
+			return err
+		}
+		if v.Kind != resp.Array || len(v.Elems) == 0 {
+			return fmt.Errorf("%w: unexpected replication message", resp.ErrProtocol)
+		}
+
+		f.mu.Lock()
+		f.status.Connected = true
+		f.status.LastContact = time.Now()
+		f.mu.Unlock()
+
+		switch args := v.Elems; args[0].Str {
+		case "PING":
+			if len(args) != 2 {
+				return fmt.Errorf("%w: bad PING", resp.ErrProtocol)
+			}
+			seq, _ := strconv.ParseInt(args[1].Str, 10, 64)
+			f.sawLeaderSeq(seq)
+		case "OP":
+			if len(args) != 2 {
+				return fmt.Errorf("%w: bad OP", resp.ErrProtocol)
+			}
+			op, _, err := decodeWALRecord([]byte(args[1].Str), NoCompression)
+			if err != nil {
+				return fmt.Errorf("replicated record: %w", err)
+			}
+			f.sawLeaderSeq(op.Seq)
+			if err := f.db.applyReplicated(op); err != nil {
+				return err
+			}
+			f.mu.Lock()
+			f.appliedAt = op.Timestamp
+			f.mu.Unlock()
+		case "SNAPSHOT":
+			if err := f.applySnapshot(conn, r, args); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown replication message %q", resp.ErrProtocol, args[0].Str)
+		}
+	}
+}
+
+func (f *Follower) sawLeaderSeq(seq int64) {
+	f.mu.Lock()
+	f.status.LeaderSeq = max(f.status.LeaderSeq, seq)
+	f.mu.Unlock()
+}
+
+// applySnapshot reads the entries announced by a SNAPSHOT message and
+// replaces the DB's contents with them.
+func (f *Follower) applySnapshot(conn net.Conn, r *resp.Reader, args []resp.Value) error {
+	if len(args) != 3 {
+		return fmt.Errorf("%w: bad SNAPSHOT", resp.ErrProtocol)
+	}
+	seq, err1 := strconv.ParseInt(args[1].Str, 10, 64)
+	count, err2 := strconv.Atoi(args[2].Str)
+	if err := errors.Join(err1, err2); err != nil || count < 0 {
+		return fmt.Errorf("%w: bad SNAPSHOT: %v", resp.ErrProtocol, err)
+	}
+
+	f.sawLeaderSeq(seq)
+	err := f.db.installSnapshot(seq, func(add func(e kvEntry)) error {
+		var prev string
+		for i := 0; i < count; i++ {
+			// The leader sends no heartbeats while it streams a snapshot.
+			conn.SetReadDeadline(time.Now().Add(replReadTimeout))
+			v, err := r.ReadValue()
+			if err != nil {
+				return err
+			}
+			if len(v.Elems) != 3 {
+				return fmt.Errorf("%w: bad snapshot entry", resp.ErrProtocol)
+			}
+			expires, err := strconv.ParseInt(v.Elems[2].Str, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w: bad snapshot entry expiry", resp.ErrProtocol)
+			}
+			key, val := v.Elems[0].Str, v.Elems[1].Str
+			if i > 0 && key <= prev {
+				return fmt.Errorf("%w: snapshot keys out of order", resp.ErrProtocol)
+			}
+			prev = key
+			add(kvEntry{key: key, val: &val, expires: expires})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.status.Snapshots++
+	f.appliedAt = 0
+	f.mu.Unlock()
+	return nil
+}
+
+// installSnapshot replaces the DB's contents with the entries read, in
+// ascending key order, by read, as of sequence number seq. They are
+// streamed into a single new table, so a snapshot need not fit in memory or
+// in a WAL record. One manifest edit then swaps that table in for every
+// other one and records seq, after which the WAL skips ahead to seq; a
+// crash before the edit leaves the DB as it was, to be resynced.
+//
+// A snapshot the DB is already past is read and discarded.
+func (db *KDB) installSnapshot(seq int64, read func(add func(e kvEntry)) error) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if seq <= db.LastSeq() {
+		return read(func(kvEntry) {})
+	}
+
+	// Compaction must not merge the tables being replaced meanwhile. Its
+	// error stays in db.compactErr for Close to report.
+	_ = db.stopCompactor()
+	defer db.startCompactor()
+
+	db.mu.Lock()
+	db.nextTable++
+	num := db.nextTable
+	db.mu.Unlock()
+
+	var readErr error
+	t, err := writeSSTable(db.tablePath(num), db.opts, func(fn func(e kvEntry)) {
+		readErr = read(func(e kvEntry) {
+			e.seq = seq
+			fn(e)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("install snapshot: %w", errors.Join(readErr, err))
+	}
+	t.num = num
+	if readErr != nil || t.keys == 0 {
+		t.obsolete.Store(true)
+		t.unref()
+		if readErr != nil {
+			return readErr
+		}
+		t = nil // the leader is empty
+	}
+	segment, err := db.wal.Rotate()
+	if err != nil {
+		if t != nil {
+			t.unref() // an orphan now; Open deletes it
+		}
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+
+	db.mu.Lock()
+	old := db.tablesNewestFirst()
+	edit := versionEdit{LogNumber: segment, NextTable: db.nextTable, LastSeq: seq}
+	for _, o := range old {
+		edit.Deleted = append(edit.Deleted, o.num)
+	}
+	prev, prevLog, prevSeq, prevStats := db.levels, db.logNumber, db.seq, db.retiredFilterStats
+	db.levels = make([][]*SSTable, maxLevels)
+	if t != nil {
+		edit.Added = []manifestTable{{Num: num, Level: 0}}
+		db.levels[0] = []*SSTable{t}
+	}
+	db.logNumber, db.seq = segment, seq
+	for _, o := range old {
+		db.retiredFilterStats = db.retiredFilterStats.add(o.FilterStats())
+	}
+	err = db.logEdit(edit)
+	if err != nil {
+		db.levels, db.logNumber, db.seq, db.retiredFilterStats = prev, prevLog, prevSeq, prevStats
+	} else {
+		db.resetMemtable()
+	}
+	db.mu.Unlock()
+	if err != nil {
+		if t != nil {
+			t.unref()
+		}
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	for _, o := range old {
+		o.obsolete.Store(true)
+		o.unref()
+	}
+
+	// Followers of this DB must not be served the records the snapshot
+	// replaced, nor mistake the jump for an empty stretch of log. Once the
+	// WAL shows the jump they are sent back to it to find that out.
+	defer db.repl.resync()
+	if segment, err = db.wal.rotateTo(seq); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+	if err := db.wal.RemoveSegmentsBefore(segment); err != nil {
+		return fmt.Errorf("remove replaced WAL segments: %w", err)
+	}
+	return nil
+}
+
+// applyReplicated logs op under the leader's sequence number and applies
+// it. Records the DB already has are ignored, so a stream may overlap what
+// was applied before a reconnect.
+func (db *KDB) applyReplicated(op WALOperation) error {
+	db.writeMu.Lock()
+	if db.closed {
+		db.writeMu.Unlock()
+		return ErrClosed
+	}
+	db.mu.RLock()
+	applied := db.seq
+	db.mu.RUnlock()
+	if op.Seq <= applied {
+		db.writeMu.Unlock()
+		return nil
+	}
+
+	wal := db.wal
+	if err := wal.appendAt(op); err != nil {
+		db.writeMu.Unlock()
+		return err
+	}
+	db.mu.Lock()
+	db.applyOp(op)
+	db.mu.Unlock()
+	db.repl.publish(op)
+
+	err := db.maybeFlush()
+	db.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return wal.waitDurable(op.Seq)
+}
+
+// runFollower serves a read-only replica of the leader at leader from the
+// DB in dir, on addr. Run it with `go run ./20-db follow <leader> [addr] [dir]`.
+func runFollower(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: follow <leader addr> [addr] [dir]")
+	}
+	leader, addr, dir := args[0], "localhost:6381", "kdb-follower"
+	if len(args) > 1 {
+		addr = args[1]
+	}
+	if len(args) > 2 {
+		dir = args[2]
+	}
+
+	db, err := Open(dir, Options{})
+	if err != nil {
+		return err
+	}
+	f := StartFollower(db, leader)
+	fmt.Printf("following %s\n", leader)
+	err = serveUntilSignal(db, addr, f)
+	f.Stop()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFollowerResyncsFromSnapshot points a follower holding stale data at a
+// leader whose WAL no longer reaches back that far, so the follower has to
+// install a snapshot, then checks it keeps streaming and survives a
+// restart.
+func TestFollowerResyncsFromSnapshot(t *testing.T) {
+	opts := Options{MemtableSize: 1 << 10, BlockSize: 128}
+	leader, err := Open(filepath.Join(t.TempDir(), "leader"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	want := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%04d", i%400)
+		if i%7 == 0 {
+			err = leader.Delete(key)
+			delete(want, key)
+		} else {
+			val := fmt.Sprintf("v%d", i)
+			err = leader.Put(key, val)
+			want[key] = val
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(leader)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	dir := filepath.Join(t.TempDir(), "follower")
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("stale", "gone after the snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	f := StartFollower(db, ln.Addr().String())
+	catchUp(t, f, leader)
+	if st := f.Status(); st.Snapshots != 1 {
+		t.Fatalf("follower installed %d snapshots, want 1", st.Snapshots)
+	}
+	checkContents(t, db, want)
+
+	// Records after the snapshot stream in one by one.
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("new%02d", i)
+		if err := leader.Put(key, "x"); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = "x"
+	}
+	catchUp(t, f, leader)
+	f.Stop()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, want := db.LastSeq(), leader.LastSeq(); got != want {
+		t.Fatalf("reopened follower at seq %d, want %d", got, want)
+	}
+	checkContents(t, db, want)
+}
+
+// catchUp waits for f to apply every record the leader has.
+func catchUp(t *testing.T, f *Follower, leader *KDB) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for f.Status().AppliedSeq != leader.LastSeq() {
+		if time.Now().After(deadline) {
+			st := f.Status()
+			t.Fatalf("follower stuck at seq %d of %d: %s", st.AppliedSeq, leader.LastSeq(), st.LastError)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkContents checks db holds exactly the keys and values in want.
+func checkContents(t *testing.T, db *KDB, want map[string]string) {
+	t.Helper()
+	n := 0
+	it := db.NewIterator(IterOptions{})
+	for ; it.Valid(); it.Next() {
+		n++
+		if val, ok := want[it.Key()]; !ok || val != it.Value() {
+			t.Errorf("%s = %q, want %q (present %v)", it.Key(), it.Value(), val, ok)
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Fatalf("found %d keys, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,336 @@
+// Package resp reads and writes the subset of the Redis serialization
+// protocol (RESP2) that the KDB server speaks: simple strings, errors,
+// integers, bulk strings and arrays, plus the inline command form that
+// telnet-style clients send.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Kind is the type of a RESP value, named by its leading byte.
+type Kind byte
+
+const (
+	SimpleString Kind = '+'
+	ErrorReply   Kind = '-'
+	Integer      Kind = ':'
+	BulkString   Kind = '$'
+	Array        Kind = '*'
+)
+
+// Limits on what a peer may send, so a bad length prefix cannot make the
+// reader allocate without bound. MaxValueSize caps one value as a whole:
+// the bytes of its bulk strings plus the memory of its array elements,
+// however deeply they nest.
+const (
+	MaxBulkLen   = 512 << 20
+	MaxArrayLen  = 1 << 20
+	MaxDepth     = 16
+	MaxValueSize = 512 << 20
+	maxInlineLen = 64 << 10
+)
+
+// valueSize is what each array element costs against MaxValueSize.
+const valueSize = int(unsafe.Sizeof(Value{}))
+
+// ErrProtocol is returned for input that is not valid RESP.
+var ErrProtocol = errors.New("resp: protocol error")
+
+// Error is an error reply sent by the peer.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// Value is one RESP value. Str holds simple strings, errors and bulk
+// strings, Int integers, and Elems arrays. Null marks the null bulk string
+// and the null array.
+type Value struct {
+	Kind  Kind
+	Str   string
+	Int   int64
+	Elems []Value
+	Null  bool
+}
+
+// Err returns the value as an error if it is an error reply, and nil
+// otherwise.
+func (v Value) Err() error {
+	if v.Kind == ErrorReply {
+		return Error(v.Str)
+	}
+	return nil
+}
+
+// Reader decodes RESP values from a stream.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Buffered returns the number of bytes already read from the stream but
+// not yet decoded. A server uses it to tell whether more pipelined
+// commands are waiting before it flushes its replies.
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadValue reads the next value.
+func (r *Reader) ReadValue() (Value, error) {
+	budget := MaxValueSize
+	return r.readValue(0, &budget)
+}
+
+// readValue reads a value nested depth arrays deep, charging what it
+// allocates to budget.
+func (r *Reader) readValue(depth int, budget *int) (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+	v := Value{Kind: Kind(line[0])}
+	body := line[1:]
+	switch v.Kind {
+	case SimpleString, ErrorReply:
+		v.Str = body
+	case Integer:
+		if v.Int, err = strconv.ParseInt(body, 10, 64); err != nil {
+			return Value{}, fmt.Errorf("%w: bad integer %q", ErrProtocol, body)
+		}
+	case BulkString:
+		n, err := parseLen(body, MaxBulkLen)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Null = true
+			break
+		}
+		if err := spend(budget, n); err != nil {
+			return Value{}, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return Value{}, unexpectedEOF(err)
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return Value{}, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+		}
+		v.Str = string(buf[:n])
+	case Array:
+		n, err := parseLen(body, MaxArrayLen)
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Null = true
+			break
+		}
+		if depth == MaxDepth {
+			return Value{}, fmt.Errorf("%w: arrays nested too deep", ErrProtocol)
+		}
+		if err := spend(budget, n*valueSize); err != nil {
+			return Value{}, err
+		}
+		// Grow with what actually arrives rather than trusting n, which
+		// costs the peer nothing to send.
+		v.Elems = make([]Value, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			e, err := r.readValue(depth+1, budget)
+			if err != nil {
+				return Value{}, unexpectedEOF(err)
+			}
+			v.Elems = append(v.Elems, e)
+		}
+	default:
+		return Value{}, fmt.Errorf("%w: unknown type byte %q", ErrProtocol, line[0])
+	}
+	return v, nil
+}
+
+// ReadCommand reads a client command: either an array of bulk strings or
+// an inline command, a line of space-separated words. Blank inline lines
+// are skipped.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		b, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if Kind(b[0]) != Array {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		v, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		args := make([]string, len(v.Elems))
+		for i, e := range v.Elems {
+			if e.Kind != BulkString || e.Null {
+				return nil, fmt.Errorf("%w: command arguments must be bulk strings", ErrProtocol)
+			}
+			args[i] = e.Str
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+// readLine reads up to the next CRLF, which it strips. A bare LF is
+// accepted as well, as inline commands typed by hand may end with one.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if len(line) > 0 {
+				return "", unexpectedEOF(err)
+			}
+			return "", err
+		}
+		if len(line) > maxInlineLen {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return string(line), nil
+}
+
+// spend charges n bytes to budget, failing once it is used up.
+func spend(budget *int, n int) error {
+	if n > *budget {
+		return fmt.Errorf("%w: value larger than %d bytes", ErrProtocol, MaxValueSize)
+	}
+	*budget -= n
+	return nil
+}
+
+func parseLen(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 || n > limit {
+		return 0, fmt.Errorf("%w: bad length %q", ErrProtocol, s)
+	}
+	return n, nil
+}
+
+// unexpectedEOF turns an EOF in the middle of a value into
+// io.ErrUnexpectedEOF, leaving plain io.EOF for a stream that ended between
+// values.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer encodes RESP values onto a buffered stream. Nothing reaches the
+// underlying writer before Flush, or before the buffer fills.
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) WriteSimple(s string) {
+	w.line(SimpleString, s)
+}
+
+// WriteError writes an error reply. By convention msg starts with an error
+// code such as "ERR" or "WRONGTYPE".
+func (w *Writer) WriteError(msg string) {
+	w.line(ErrorReply, strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+func (w *Writer) WriteInt(n int64) {
+	w.line(Integer, strconv.FormatInt(n, 10))
+}
+
+func (w *Writer) WriteBulk(s string) {
+	w.line(BulkString, strconv.Itoa(len(s)))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// WriteNull writes the null bulk string, RESP2's "no value".
+func (w *Writer) WriteNull() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// WriteArrayHeader starts an array of n values; the caller writes them next.
+func (w *Writer) WriteArrayHeader(n int) {
+	w.line(Array, strconv.Itoa(n))
+}
+
+// WriteCommand writes a command the way clients send it: an array of bulk
+// strings.
+func (w *Writer) WriteCommand(args ...string) {
+	w.WriteArrayHeader(len(args))
+	for _, a := range args {
+		w.WriteBulk(a)
+	}
+}
+
+// WriteValue writes v, including any nested values.
+func (w *Writer) WriteValue(v Value) {
+	switch {
+	case v.Null && v.Kind == Array:
+		w.w.WriteString("*-1\r\n")
+	case v.Null:
+		w.WriteNull()
+	case v.Kind == SimpleString:
+		w.WriteSimple(v.Str)
+	case v.Kind == ErrorReply:
+		w.WriteError(v.Str)
+	case v.Kind == Integer:
+		w.WriteInt(v.Int)
+	case v.Kind == BulkString:
+		w.WriteBulk(v.Str)
+	case v.Kind == Array:
+		w.WriteArrayHeader(len(v.Elems))
+		for _, e := range v.Elems {
+			w.WriteValue(e)
+		}
+	}
+}
+
+// Flush writes any buffered values to the underlying writer and reports
+// the first error hit by any write since the previous Flush.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *Writer) line(k Kind, s string) {
+	w.w.WriteByte(byte(k))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
@@ -0,0 +1,41 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReadValueLimits(t *testing.T) {
+	tests := []struct {
+		name, input string
+	}{
+		{"nested too deep", strings.Repeat("*1\r\n", MaxDepth+1) + ":1\r\n"},
+		// Each header claims more elements than were ever sent; the claims
+		// alone run through the budget before any of them arrive.
+		{"arrays over the value budget", strings.Repeat("*"+strconv.Itoa(MaxArrayLen)+"\r\n", 9)},
+		{"bulk string over the value budget", "*2\r\n$" + strconv.Itoa(MaxBulkLen) + "\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input))
+			if _, err := r.ReadValue(); !errors.Is(err, ErrProtocol) {
+				t.Fatalf("ReadValue returned %v, want ErrProtocol", err)
+			}
+		})
+	}
+
+	// Exactly MaxDepth levels are fine.
+	r := NewReader(strings.NewReader(strings.Repeat("*1\r\n", MaxDepth) + ":7\r\n"))
+	v, err := r.ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxDepth; i++ {
+		v = v.Elems[0]
+	}
+	if v.Int != 7 {
+		t.Fatalf("innermost value %d, want 7", v.Int)
+	}
+}
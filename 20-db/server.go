@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golangdsa/20-db/resp"
+)
+
+// defaultServerAddr is where `serve` listens when no address is given; one
+// above Redis's port so both can run side by side.
+const defaultServerAddr = "localhost:6380"
+
+// maxScanCursors bounds the SCAN cursors a server remembers. The oldest is
+// forgotten first; resuming from it fails with "invalid cursor".
+const maxScanCursors = 4096
+
+// maxScanCount caps the COUNT of a SCAN call. COUNT is only a hint, so a
+// larger one just takes more calls instead of one unbounded reply.
+const maxScanCount = 10000
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("kdb: server closed")
+
+// Server exposes a KDB over TCP using a subset of the Redis protocol, so
+// redis-cli and Redis client libraries can talk to it: GET, SET (with EX,
+// PX, NX and XX), DEL, EXISTS, SCAN (with MATCH and COUNT), PING, INFO and
+// QUIT. Clients may pipeline: replies are buffered while more commands are
+// waiting and written together. Followers replicate from the same port
+// with SYNC; see replication.go.
+type Server struct {
+	db       *KDB
+	follower *Follower // set when db replicates from a leader
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	shutdown bool
+	quit     chan struct{} // closed by Shutdown
+	connWG   sync.WaitGroup
+
+	cursors scanCursors
+
+	started     time.Time
+	connections atomic.Int64 // accepted so far
+	commands    atomic.Int64 // executed so far
+}
+
+// NewServer returns a server for db. The server does not own db: after
+// Shutdown the caller closes it, which syncs the WAL.
+func NewServer(db *KDB) *Server {
+	return &Server{
+		db:      db,
+		conns:   make(map[net.Conn]struct{}),
+		quit:    make(chan struct{}),
+		cursors: scanCursors{byID: make(map[uint64]string)},
+		started: time.Now(),
+	}
+}
+
+// Serve accepts connections on ln and serves each on its own goroutine
+// until Shutdown is called, when it returns ErrServerClosed. ln is closed
+// when Serve returns.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isShutdown() {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		s.mu.Lock()
+		if s.shutdown {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.connWG.Add(1)
+		s.mu.Unlock()
+		s.connections.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and lets every client finish the
+// command it is running; its reply is flushed before the connection
+// closes. If ctx ends first the remaining connections are closed at once
+// and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.shutdown {
+		s.shutdown = true
+		close(s.quit)
+	}
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	// Wake connections blocked waiting for a command. Busy ones see
+	// s.shutdown once their command is done.
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isShutdown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.connWG.Done()
+	}()
+
+	r, w := resp.NewReader(conn), resp.NewWriter(conn)
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if errors.Is(err, resp.ErrProtocol) {
+				w.WriteError("ERR " + err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if strings.EqualFold(args[0], "SYNC") {
+			// The connection becomes a replication stream to a follower.
+			s.commands.Add(1)
+			after, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+			if len(args) != 2 || err != nil || after < 0 {
+				w.WriteError("ERR usage: SYNC <seq>")
+				if w.Flush() != nil {
+					return
+				}
+				continue
+			}
+			if w.Flush() == nil {
+				s.replicate(w, after)
+			}
+			return
+		}
+		quit := s.exec(w, args)
+		s.commands.Add(1)
+
+		// Replies to pipelined commands go out together, once the client
+		// has no more commands in flight. Nothing is left unflushed before
+		// the next read blocks.
+		stop := quit || s.isShutdown()
+		if stop || r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// exec runs one command and writes its reply. It reports whether the
+// client asked to close the connection.
+func (s *Server) exec(w *resp.Writer, args []string) (quit bool) {
+	name := strings.ToUpper(args[0])
+	arity, ok := serverCommands[name]
+	if !ok {
+		w.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if len(args) < arity.min || (arity.max > 0 && len(args) > arity.max) {
+		w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+
+	switch name {
+	case "PING":
+		if len(args) == 2 {
+			w.WriteBulk(args[1])
+		} else {
+			w.WriteSimple("PONG")
+		}
+	case "QUIT":
+		w.WriteSimple("OK")
+		return true
+	case "GET":
+		switch v, ok, err := s.db.Get(args[1]); {
+		case err != nil:
+			writeDBError(w, err)
+		case ok:
+			w.WriteBulk(v)
+		default:
+			w.WriteNull()
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		n := int64(0)
+		for _, key := range args[1:] {
+			err := s.db.apply(WALOperation{Operation: opDelete, Key: key}, func() error {
+				_, ok, err := s.db.Get(key)
+				if err == nil && !ok {
+					return ErrKeyNotFound
+				}
+				return err
+			})
+			switch {
+			case err == nil:
+				n++
+			case !errors.Is(err, ErrKeyNotFound):
+				writeDBError(w, err)
+				return false
+			}
+		}
+		w.WriteInt(n)
+	case "EXISTS":
+		n := int64(0)
+		for _, key := range args[1:] {
+			_, ok, err := s.db.Get(key)
+			if err != nil {
+				writeDBError(w, err)
+				return false
+			}
+			if ok {
+				n++
+			}
+		}
+		w.WriteInt(n)
+	case "SCAN":
+		s.scan(w, args)
+	case "INFO":
+		section := ""
+		if len(args) == 2 {
+			section = args[1]
+		}
+		w.WriteBulk(s.info(section))
+	}
+	return false
+}
+
+// commandArity is the number of arguments, command name included, that a
+// command accepts; max 0 means no upper bound.
+type commandArity struct{ min, max int }
+
+var serverCommands = map[string]commandArity{
+	"PING":   {1, 2},
+	"QUIT":   {1, 1},
+	"GET":    {2, 2},
+	"SET":    {3, 0},
+	"DEL":    {2, 0},
+	"EXISTS": {2, 0},
+	"SCAN":   {2, 0},
+	"INFO":   {1, 2},
+}
+
+// set implements SET key value [EX seconds | PX milliseconds] [NX | XX].
+// Under NX or XX the check and the write are one atomic step.
+func (s *Server) set(w *resp.Writer, args []string) {
+	op := WALOperation{Operation: opPut, Key: args[1], Value: args[2]}
+	var check func() error
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case (opt == "EX" || opt == "PX") && i+1 < len(args) && op.ExpiresAt == 0:
+			unit := time.Millisecond
+			if opt == "EX" {
+				unit = time.Second
+			}
+			// The expiry time is in nanoseconds, so a TTL too long for it
+			// would wrap around to a time long past.
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			now := s.db.now()
+			if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) ||
+				now > math.MaxInt64-n*int64(unit) {
+				w.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+			op.ExpiresAt = now + n*int64(unit)
+			i++
+		case opt == "NX" && check == nil:
+			check = func() error {
+				_, ok, err := s.db.Get(op.Key)
+				if err == nil && ok {
+					return ErrKeyExists
+				}
+				return err
+			}
+		case opt == "XX" && check == nil:
+			check = func() error {
+				_, ok, err := s.db.Get(op.Key)
+				if err == nil && !ok {
+					return ErrKeyNotFound
+				}
+				return err
+			}
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	err := s.db.apply(op, check)
+	switch {
+	case err == nil:
+		w.WriteSimple("OK")
+	case errors.Is(err, ErrKeyExists), errors.Is(err, ErrKeyNotFound):
+		// The condition did not hold: Redis answers with a null reply.
+		w.WriteNull()
+	default:
+		writeDBError(w, err)
+	}
+}
+
+// writeDBError replies with err, flagging writes refused by a follower the
+// way Redis replicas do so clients can tell them apart.
+func writeDBError(w *resp.Writer, err error) {
+	if errors.Is(err, ErrReadOnly) {
+		w.WriteError("READONLY " + err.Error())
+		return
+	}
+	w.WriteError("ERR " + err.Error())
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count]. Keys are
+// visited in order; the cursor handed back stands for the next key to
+// visit, so every key that exists for the whole iteration is returned
+// exactly once however the DB changes in between.
+func (s *Server) scan(w *resp.Writer, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.WriteError("ERR invalid cursor")
+		return
+	}
+	pattern, count := "", 10
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "MATCH" && i+1 < len(args):
+			pattern = args[i+1]
+			i++
+		case opt == "COUNT" && i+1 < len(args):
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			count = min(count, maxScanCount)
+			i++
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	var opts IterOptions
+	if cursor != 0 {
+		start, ok := s.cursors.get(cursor)
+		if !ok {
+			w.WriteError("ERR invalid cursor")
+			return
+		}
+		opts.Start = start
+	}
+	// Only keys with the pattern's literal prefix can match.
+	if prefix := globPrefix(pattern); prefix != "" {
+		opts.Start = max(opts.Start, prefix)
+		opts.End = prefixEnd(prefix)
+	}
+
+	// The iterator reads lazily, so a call costs the COUNT keys it visits
+	// plus the one the next cursor resumes from, however large the DB.
+	it := s.db.NewIterator(opts)
+	var keys []string
+	for n := 0; it.Valid() && n < count; it.Next() {
+		if pattern == "" || matchGlob(pattern, it.Key()) {
+			keys = append(keys, it.Key())
+		}
+		n++
+	}
+	next := uint64(0)
+	if it.Valid() {
+		next = s.cursors.put(it.Key())
+	}
+	if err := it.Close(); err != nil {
+		w.WriteError("ERR " + err.Error())
+		return
+	}
+
+	w.WriteArrayHeader(2)
+	w.WriteBulk(strconv.FormatUint(next, 10))
+	w.WriteArrayHeader(len(keys))
+	for _, k := range keys {
+		w.WriteBulk(k)
+	}
+}
+
+// scanCursors maps the numeric cursors SCAN hands out, which is what Redis
+// clients expect, to the key each one resumes from.
+type scanCursors struct {
+	mu    sync.Mutex
+	last  uint64
+	byID  map[uint64]string
+	order []uint64 // oldest first
+}
+
+func (c *scanCursors) put(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last++
+	c.byID[c.last] = key
+	c.order = append(c.order, c.last)
+	if len(c.order) > maxScanCursors {
+		delete(c.byID, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.last
+}
+
+func (c *scanCursors) get(id uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.byID[id]
+	return key, ok
+}
+
+// info renders the INFO report, or just one section of it.
+func (s *Server) info(section string) string {
+	db := s.db
+	db.mu.RLock()
+	memEntries, memBytes, seq := db.Size, db.memBytes, db.seq
+	tablesPerLevel := make([]int, len(db.levels))
+	for level, tables := range db.levels {
+		tablesPerLevel[level] = len(tables)
+	}
+	db.mu.RUnlock()
+	s.mu.Lock()
+	clients := len(s.conns)
+	s.mu.Unlock()
+	filter := db.FilterStats()
+
+	sections := []struct {
+		name   string
+		fields [][2]string
+	}{
+		{"server", [][2]string{
+			{"process_id", strconv.Itoa(os.Getpid())},
+			{"uptime_in_seconds", strconv.Itoa(int(time.Since(s.started).Seconds()))},
+			{"db_dir", db.dir},
+		}},
+		{"clients", [][2]string{
+			{"connected_clients", strconv.Itoa(clients)},
+		}},
+		{"stats", [][2]string{
+			{"total_connections_received", strconv.FormatInt(s.connections.Load(), 10)},
+			{"total_commands_processed", strconv.FormatInt(s.commands.Load(), 10)},
+			{"bloom_checks", strconv.FormatInt(filter.Checks, 10)},
+			{"bloom_hit_rate", strconv.FormatFloat(filter.HitRate(), 'f', 4, 64)},
+		}},
+		{"replication", s.replicationInfo()},
+		{"storage", [][2]string{
+			{"last_seq", strconv.FormatInt(seq, 10)},
+			{"memtable_entries", strconv.Itoa(memEntries)},
+			{"memtable_bytes", strconv.Itoa(memBytes)},
+			{"sstables_per_level", strings.Trim(fmt.Sprint(tablesPerLevel), "[]")},
+			{"compaction", db.opts.Compaction.String()},
+			{"wal_sync", db.opts.WAL.Sync.String()},
+		}},
+	}
+
+	var b strings.Builder
+	for _, sec := range sections {
+		if section != "" && !strings.EqualFold(section, sec.name) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(sec.name[:1]), sec.name[1:])
+		for _, f := range sec.fields {
+			fmt.Fprintf(&b, "%s:%s\r\n", f[0], f[1])
+		}
+	}
+	return b.String()
+}
+
+func (s *Server) replicationInfo() [][2]string {
+	if s.follower == nil {
+		return [][2]string{
+			{"role", "leader"},
+			{"connected_followers", strconv.Itoa(s.db.repl.followers())},
+		}
+	}
+	st := s.follower.Status()
+	link := "down"
+	if st.Connected {
+		link = "up"
+	}
+	return [][2]string{
+		{"role", "follower"},
+		{"leader", st.Leader},
+		{"leader_link_status", link},
+		{"applied_seq", strconv.FormatInt(st.AppliedSeq, 10)},
+		{"leader_seq", strconv.FormatInt(st.LeaderSeq, 10)},
+		{"lag_records", strconv.FormatInt(st.LagRecords(), 10)},
+		{"lag_ms", strconv.FormatInt(st.Lag.Milliseconds(), 10)},
+		{"reconnects", strconv.Itoa(st.Reconnects)},
+		{"full_resyncs", strconv.Itoa(st.Snapshots)},
+		{"last_error", st.LastError},
+	}
+}
+
+// globPrefix returns the literal text a glob pattern starts with.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// matchGlob reports whether s matches the Redis-style glob pattern: *
+// matches any run of bytes, ? any single byte, [abc], [a-z] and [^a] match
+// a byte from (or not from) a set, and \ makes the next byte literal.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			if s == "" {
+				return false
+			}
+			n, ok := matchClass(pattern, s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = pattern[n:], s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// matchClass matches c against the [...] class at the start of pattern and
+// returns the length of the class. An unterminated class runs to the end
+// of the pattern.
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return min(i+1, len(pattern)), matched != negate
+}
+
+// runServer serves the DB in dir on addr until interrupted, then shuts
+// down gracefully and closes the DB, syncing the WAL. Run it with
+// `go run ./20-db serve [addr] [dir]`.
+func runServer(args []string) error {
+	addr, dir := defaultServerAddr, "kdb-server"
+	if len(args) > 0 {
+		addr = args[0]
+	}
+	if len(args) > 1 {
+		dir = args[1]
+	}
+
+	db, err := Open(dir, Options{})
+	if err != nil {
+		return err
+	}
+	err = serveUntilSignal(db, addr, nil)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// serveUntilSignal serves db on addr until SIGINT or SIGTERM, then shuts
+// the server down gracefully. follower is the DB's replication from a
+// leader, if any.
+func serveUntilSignal(db *KDB, addr string, follower *Follower) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := NewServer(db)
+	srv.follower = follower
+	fmt.Printf("serving %s on %s\n", db.dir, ln.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+
+	select {
+	case err = <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	fmt.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if serveErr := <-serveErr; !errors.Is(serveErr, ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golangdsa/20-db/client"
+)
+
+// TestScanVisitsEveryKey scans a DB spread over the memtable and many
+// tables in small steps, deleting keys behind the cursor as it goes, and
+// checks every key that was never deleted comes back exactly once.
+func TestScanVisitsEveryKey(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{MemtableSize: 1 << 10, BlockSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Registered first so it runs after serve's cleanups.
+	t.Cleanup(func() { db.Close() })
+	var want []string
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(key, "key1") {
+			want = append(want, key)
+		}
+	}
+
+	c := serve(t, db)
+	seen := make(map[string]int)
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(cursor, "key1*", 37)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > 37 {
+			t.Fatalf("SCAN COUNT 37 returned %d keys", len(keys))
+		}
+		for _, k := range keys {
+			seen[k]++
+			// Keys already returned may go; the rest must still turn up.
+			if _, err := c.Del(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	var got []string
+	for k, n := range seen {
+		if n != 1 {
+			t.Errorf("%s returned %d times", k, n)
+		}
+		got = append(got, k)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("scan returned %d keys, want %d", len(got), len(want))
+	}
+}
+
+// TestSetRejectsOverflowingExpiry checks SET refuses a TTL whose expiry
+// time does not fit in an int64 instead of storing the key already
+// expired.
+func TestSetRejectsOverflowingExpiry(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	c := serve(t, db)
+
+	for _, ttl := range [][]string{
+		{"EX", "9999999999"},
+		{"EX", strconv.FormatInt(math.MaxInt64/int64(time.Second), 10)}, // fits, but not added to now
+		{"PX", strconv.FormatInt(math.MaxInt64, 10)},
+	} {
+		_, err := c.Do(append([]string{"SET", "k", "v"}, ttl...)...)
+		if err == nil || err.Error() != "ERR invalid expire time in 'set' command" {
+			t.Errorf("SET k v %s: %v", strings.Join(ttl, " "), err)
+		}
+		if _, ok, err := c.Get("k"); err != nil || ok {
+			t.Fatalf("after SET k v %s: present %v, %v", strings.Join(ttl, " "), ok, err)
+		}
+	}
+
+	// A century is long but fine.
+	if _, err := c.Do("SET", "k", "v", "EX", strconv.Itoa(100*365*24*3600)); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := c.Get("k"); err != nil || !ok || val != "v" {
+		t.Fatalf("GET k = %q, %v, %v", val, ok, err)
+	}
+}
+
+// serve runs a server for db until the test ends and returns a client
+// connected to it. Both are shut down in cleanups.
+func serve(t *testing.T, db *KDB) *client.Client {
+	t.Helper()
+	srv := NewServer(db)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	c, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
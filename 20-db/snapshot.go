@@ -0,0 +1,178 @@
+package main
+
+import "math"
+
+// Snapshot is a read-only view of a KDB as of one sequence number. Writes
+// that land after the snapshot was taken are invisible to it, as are
+// flushes and compactions: the snapshot pins the memtable and the SSTables
+// it started from. It must be released with Release, and must not be used
+// afterwards.
+type Snapshot struct {
+	db     *KDB
+	seq    int64
+	gen    int        // generation of the memtable the snapshot reads
+	tables []*SSTable // pinned, newest first
+}
+
+// Snapshot returns a consistent view of the DB as of the last applied
+// write.
+func (db *KDB) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := &Snapshot{db: db, seq: db.seq, gen: db.memGen, tables: db.tablesNewestFirst()}
+	for _, t := range s.tables {
+		t.ref()
+	}
+	if db.snapshots == nil {
+		db.snapshots = make(map[*Snapshot]struct{})
+	}
+	db.snapshots[s] = struct{}{}
+	return s
+}
+
+// Seq returns the sequence number the snapshot reads at: it sees every
+// write up to and including Seq, and none after.
+func (s *Snapshot) Seq() int64 {
+	return s.seq
+}
+
+// Release unpins the snapshot's memtable and tables so they can be
+// reclaimed. Releasing twice is a no-op.
+func (s *Snapshot) Release() {
+	db := s.db
+	db.mu.Lock()
+	if _, ok := db.snapshots[s]; !ok {
+		db.mu.Unlock()
+		return
+	}
+	delete(db.snapshots, s)
+	if s.gen != db.memGen && !db.memGenInUse(s.gen) {
+		delete(db.frozenMems, s.gen)
+	}
+	// Writes prune the keys they touch; keys nobody writes again are swept
+	// here once old versions outnumber the keys themselves.
+	if db.oldVersions > db.Size {
+		db.collectVersions()
+	}
+	db.mu.Unlock()
+
+	for _, t := range s.tables {
+		t.unref()
+	}
+}
+
+// Get returns the value key had when the snapshot was taken. Expiry is
+// wall-clock time, not part of the snapshot: a value that has expired since
+// reads as absent here too. Like KDB.Get it fails if a table that may hold
+// key cannot be read.
+func (s *Snapshot) Get(key string) (string, bool, error) {
+	now := s.db.now()
+	s.db.mu.RLock()
+	var v *version
+	if slot := s.db.slotIn(s.memRoot(), key); slot != nil {
+		v = (*slot).at(s.seq)
+	}
+	var val string
+	var ok bool
+	if v != nil {
+		val, ok = v.value(now)
+	}
+	s.db.mu.RUnlock()
+
+	if v != nil {
+		return val, ok, nil
+	}
+	return lookupTables(s.tables, key, now)
+}
+
+// NewIterator returns an iterator over the live keys within opts as of the
+// snapshot. It must be closed before the snapshot is released.
+func (s *Snapshot) NewIterator(opts IterOptions) Iterator {
+	return s.newIterator(opts, s.db.now())
+}
+
+// newIterator merges the snapshot's memtable and tables, newest first, into
+// an iterator over the keys live at now.
+func (s *Snapshot) newIterator(opts IterOptions, now int64) *mergingIterator {
+	sources := []recordIterator{newMemIterator(s, opts)}
+	for _, t := range s.tables {
+		sources = append(sources, newTableIterator(t, opts))
+	}
+	return newMergingIterator(sources, opts.Reverse, now, nil)
+}
+
+// Range returns a forward iterator over keys in [start, end).
+func (s *Snapshot) Range(start, end string) Iterator {
+	return s.NewIterator(IterOptions{Start: start, End: end})
+}
+
+// Prefix returns a forward iterator over keys starting with p.
+func (s *Snapshot) Prefix(p string) Iterator {
+	return s.NewIterator(IterOptions{Start: p, End: prefixEnd(p)})
+}
+
+// memEntries collects the memtable entries within opts visible at the
+// snapshot, tombstones included.
+func (s *Snapshot) memEntries(opts IterOptions) []kvEntry {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	var mem []kvEntry
+	s.db.walkRange(s.memRoot(), opts, s.seq, false, func(e kvEntry) bool {
+		mem = append(mem, e)
+		return true
+	})
+	return mem
+}
+
+// memRoot returns the root of the memtable the snapshot was taken against:
+// the live one, or a frozen one if it has been flushed since. Callers hold
+// db.mu.
+func (s *Snapshot) memRoot() *Node {
+	if s.gen == s.db.memGen {
+		return s.db.head
+	}
+	return s.db.frozenMems[s.gen]
+}
+
+// collectVersions drops every memtable version that is older than what the
+// oldest open snapshot can see. Callers hold db.mu.
+func (db *KDB) collectVersions() {
+	oldest := db.oldestSnapshot()
+	var walk func(n *Node)
+	walk = func(n *Node) {
+		if n == nil {
+			return
+		}
+		_, vals, kids := db.unpackNode(n)
+		for _, v := range vals {
+			db.oldVersions -= v.prune(oldest)
+		}
+		for _, kid := range kids {
+			walk(kid)
+		}
+	}
+	walk(db.head)
+}
+
+// oldestSnapshot returns the sequence number of the oldest open snapshot,
+// or math.MaxInt64 if there is none. Callers hold db.mu.
+func (db *KDB) oldestSnapshot() int64 {
+	oldest := int64(math.MaxInt64)
+	for s := range db.snapshots {
+		oldest = min(oldest, s.seq)
+	}
+	return oldest
+}
+
+// memGenInUse reports whether an open snapshot reads memtable generation
+// gen. Callers hold db.mu.
+func (db *KDB) memGenInUse(gen int) bool {
+	for s := range db.snapshots {
+		if s.gen == gen {
+			return true
+		}
+	}
+	return false
+}
@@ -2,22 +2,105 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
-	"strconv"
-	"strings"
+	"sort"
+	"sync/atomic"
 )
 
-// SSTable is a simple immutable sorted-string table stored on disk.
-// Keys are hashed ints (using HashStringToInt) and values are plain strings.
+// SSTable is an immutable sorted table stored on disk in a binary,
+// block-based format (version 1):
+//
+//	[data block 0][crc] ... [data block n][crc]
+//	[index][crc]
+//	[metadata][crc]
+//	[footer]
+//
+// Data blocks hold length-prefixed records sorted by key; a new block is
+// started once the current one reaches the configured block size. Every
+// record is
+//
+//	flags:1 | uvarint keyLen | uvarint valLen | [uvarint seq] | [varint expires] | key | value
+//
+// where flags bit 0 marks a tombstone, bit 1 says the sequence number of
+// the write is present (tables written before it was recorded lack it) and
+// bit 2 says the value expires, at the given Unix time in nanoseconds.
+// Blocks are stored compressed with the codec named by the "compression"
+// property (none if it is absent). The index has one entry per block (its
+// last key, offset and stored length) so a lookup reads exactly one block.
+// The metadata section is a list of named properties (key count, key
+// range, Bloom filter, ...). The fixed-size footer at the very end locates
+// the index and metadata and carries the format version and a magic number.
+// Each section is followed by the CRC32 of its stored contents.
+//
+// Opening a table only reads the footer, index and metadata; data blocks are
+// read on demand, and only after the Bloom filter says the key may be there.
 type SSTable struct {
-	path  string
-	file  *os.File
-	index map[int]int64 // key hash -> byte offset of line start
+	path   string
+	fs     FS
+	file   File
+	blocks []blockHandle // sparse index, one entry per data block
+
+	num    int    // file number assigned by the KDB, 0 for standalone tables
+	level  int    // LSM level the table lives in
+	minKey string // smallest key in the table
+	maxKey string // largest key in the table
+	size   int64  // file size in bytes
+	keys   int    // number of records, tombstones included
+
+	filter      *bloomFilter // nil when the table was written without one
+	filterStats filterCounters
+	compression Compression // codec of the data blocks
+
+	// refs counts the table set and the snapshots holding the table; the
+	// file is closed when the last one goes, and deleted as well if
+	// compaction has made the table obsolete.
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+// blockHandle locates one data block and the largest key stored in it.
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	length  int64 // excluding the trailing CRC
+}
+
+const (
+	sstMagic         uint64 = 0x4b44425353540001 // "KDBSST" + 0x0001
+	sstVersion       uint32 = 1
+	sstFooterSize           = 4*8 + 4 + 8
+	defaultBlockSize        = 4 << 10
+
+	recordFlagTombstone = 1 << 0
+	recordFlagSeq       = 1 << 1
+	recordFlagExpiry    = 1 << 2
+)
+
+// ErrCorruptSSTable is returned when a table fails a checksum or cannot be
+// decoded.
+var ErrCorruptSSTable = errors.New("kdb: corrupt sstable")
+
+// ForEachInOrder traverses the B-tree in sorted order and calls fn for each
+// live key/value. Tombstones and expired values are skipped.
+func (db *KDB) ForEachInOrder(fn func(key string, val string)) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	now := db.now()
+	db.forEachEntry(func(key string, v *version) {
+		if val, ok := v.value(now); ok {
+			fn(key, val)
+		}
+	})
 }
 
-// ForEachInOrder traverses the B-tree in sorted order and calls fn for each key/value.
-func (db *KDB) ForEachInOrder(fn func(key int, val string)) {
+// forEachEntry traverses the B-tree in sorted order, including tombstones.
+// Each key is reported with its newest version.
+func (db *KDB) forEachEntry(fn func(key string, v *version)) {
 	var walk func(n *Node)
 	walk = func(n *Node) {
 		if n == nil {
@@ -25,18 +108,18 @@ func (db *KDB) ForEachInOrder(fn func(key int, val string)) {
 		}
 		// cp1, key1
 		walk(n.cp1)
-		if n.rp1 != nil {
-			fn(n.key1, *n.rp1)
+		if n.size >= 1 {
+			fn(n.key1, n.rp1)
 		}
 		// cp2, key2
 		walk(n.cp2)
-		if n.size >= 2 && n.rp2 != nil {
-			fn(n.key2, *n.rp2)
+		if n.size >= 2 {
+			fn(n.key2, n.rp2)
 		}
 		// cp3, key3
 		walk(n.cp3)
-		if n.size >= 3 && n.rp3 != nil {
-			fn(n.key3, *n.rp3)
+		if n.size >= 3 {
+			fn(n.key3, n.rp3)
 		}
 		// cp4
 		walk(n.cp4)
@@ -44,94 +127,319 @@ func (db *KDB) ForEachInOrder(fn func(key int, val string)) {
 	walk(db.head)
 }
 
-// BuildSSTable creates an SSTable file from the current DB contents.
-// The file is rewritten (truncated) each time.
+// BuildSSTable creates an SSTable file from the memtable contents as of a
+// snapshot, so writes that land while the table is being written do not
+// leak into it. A table already at path is replaced atomically: a crash
+// mid-build leaves it intact.
 func BuildSSTable(db *KDB, path string) (*SSTable, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	entries := snap.memEntries(IterOptions{})
+	return writeSSTable(path, db.opts, func(fn func(e kvEntry)) {
+		for _, e := range entries {
+			fn(e)
+		}
+	})
+}
+
+// writeSSTable writes the records produced by walk, which must come in
+// ascending key order, to a new table at path. A nil value is written as a
+// tombstone. The table is written and synced under a temporary name and
+// only then renamed to path.
+func writeSSTable(path string, opts Options, walk func(fn func(e kvEntry))) (*SSTable, error) {
+	opts = opts.withDefaults()
+	tmp := path + tmpSuffix
+	f, err := opts.FS.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("open sstable: %w", err)
 	}
-	w := bufio.NewWriter(f)
-	index := make(map[int]int64)
-	var pos int64
+	t := &SSTable{path: path, fs: opts.FS, file: f, compression: opts.Compression}
+	t.refs.Store(1)
+	w := &sstWriter{w: bufio.NewWriter(f)}
 
-	db.ForEachInOrder(func(key int, val string) {
-		line := fmt.Sprintf("%d\t%s\n", key, val)
-		index[key] = pos
-		_, _ = w.WriteString(line)
-		pos += int64(len(line))
+	var block []byte
+	var lastKey string
+	var hashes [][2]uint32
+	flushBlock := func() {
+		if len(block) == 0 {
+			return
+		}
+		data, err := t.compression.Compress(block)
+		if err != nil {
+			if w.err == nil {
+				w.err = fmt.Errorf("compress block: %w", err)
+			}
+			return
+		}
+		off, n := w.section(data)
+		t.blocks = append(t.blocks, blockHandle{lastKey: lastKey, offset: off, length: n})
+		block = block[:0]
+	}
+
+	walk(func(e kvEntry) {
+		key := e.key
+		block = appendRecord(block, e)
+		lastKey = key
+		if t.keys == 0 {
+			t.minKey = key
+		}
+		t.maxKey = key
+		t.keys++
+		if opts.BloomBitsPerKey > 0 {
+			h1, h2 := bloomHash(key)
+			hashes = append(hashes, [2]uint32{h1, h2})
+		}
+		if len(block) >= opts.BlockSize {
+			flushBlock()
+		}
 	})
+	flushBlock()
+	if opts.BloomBitsPerKey > 0 {
+		t.filter = newBloomFilter(hashes, opts.BloomBitsPerKey)
+	}
 
-	if err := w.Flush(); err != nil {
-		f.Close()
-		return nil, fmt.Errorf("flush sstable: %w", err)
+	indexOff, indexLen := w.section(encodeIndex(t.blocks))
+	metaOff, metaLen := w.section(encodeProperties(t.properties()))
+
+	var footer [sstFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], uint64(indexOff))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(indexLen))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(metaOff))
+	binary.LittleEndian.PutUint64(footer[24:], uint64(metaLen))
+	binary.LittleEndian.PutUint32(footer[32:], sstVersion)
+	binary.LittleEndian.PutUint64(footer[36:], sstMagic)
+	w.write(footer[:])
+	t.size = w.off
+
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	if w.err == nil {
+		w.err = f.Sync()
+	}
+	if w.err == nil {
+		w.err = installFile(opts.FS, tmp, path)
 	}
-	if err := f.Sync(); err != nil {
+	if w.err != nil {
 		f.Close()
-		return nil, fmt.Errorf("sync sstable: %w", err)
+		opts.FS.Remove(tmp)
+		return nil, fmt.Errorf("write sstable: %w", w.err)
 	}
+	return t, nil
+}
+
+// sstWriter tracks the file offset and the first write error.
+type sstWriter struct {
+	w   *bufio.Writer
+	off int64
+	err error
+}
+
+func (w *sstWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(p)
+	w.off += int64(n)
+	w.err = err
+}
 
-	return &SSTable{path: path, file: f, index: index}, nil
+// section writes data followed by its CRC32 and returns where the data
+// starts and how long it is.
+func (w *sstWriter) section(data []byte) (int64, int64) {
+	off := w.off
+	w.write(data)
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+	w.write(sum[:])
+	return off, int64(len(data))
 }
 
-// LoadSSTable opens an existing SSTable and builds its in-memory index.
+// LoadSSTable opens an existing SSTable, reading its footer, index and
+// metadata. Data blocks stay on disk until a lookup needs them.
 func LoadSSTable(path string) (*SSTable, error) {
-	f, err := os.Open(path)
+	return loadSSTable(OSFS, path)
+}
+
+// loadSSTable is LoadSSTable on the file system fs.
+func loadSSTable(fs FS, path string) (*SSTable, error) {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, fmt.Errorf("open sstable: %w", err)
 	}
+	t := &SSTable{path: path, fs: fs, file: f, compression: NoCompression}
+	t.refs.Store(1)
+	if err := t.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("load sstable %s: %w", path, err)
+	}
+	return t, nil
+}
 
-	index := make(map[int]int64)
-	scanner := bufio.NewScanner(f)
-	var offset int64
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "\t", 2)
-		if len(parts) != 2 {
-			offset += int64(len(line) + 1)
-			continue
-		}
-		k, err := strconv.Atoi(parts[0])
-		if err == nil {
-			index[k] = offset
-		}
-		offset += int64(len(line) + 1) // +1 for newline
+func (s *SSTable) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		f.Close()
-		return nil, fmt.Errorf("scan sstable: %w", err)
+	s.size = info.Size()
+	if s.size < sstFooterSize {
+		return fmt.Errorf("%w: file too small", ErrCorruptSSTable)
 	}
 
-	// Reset file pointer for reads
-	if _, err := f.Seek(0, 0); err != nil {
-		f.Close()
-		return nil, fmt.Errorf("seek sstable: %w", err)
+	var footer [sstFooterSize]byte
+	if _, err := s.file.ReadAt(footer[:], s.size-sstFooterSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[36:]) != sstMagic {
+		return fmt.Errorf("%w: bad magic number", ErrCorruptSSTable)
+	}
+	if v := binary.LittleEndian.Uint32(footer[32:]); v != sstVersion {
+		return fmt.Errorf("unsupported sstable version %d", v)
+	}
+
+	index, err := s.readSection(int64(binary.LittleEndian.Uint64(footer[0:])), int64(binary.LittleEndian.Uint64(footer[8:])))
+	if err != nil {
+		return fmt.Errorf("index: %w", err)
+	}
+	if s.blocks, err = decodeIndex(index); err != nil {
+		return err
 	}
 
-	return &SSTable{path: path, file: f, index: index}, nil
+	meta, err := s.readSection(int64(binary.LittleEndian.Uint64(footer[16:])), int64(binary.LittleEndian.Uint64(footer[24:])))
+	if err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+	props, err := decodeProperties(meta)
+	if err != nil {
+		return err
+	}
+	return s.setProperties(props)
 }
 
-// Get looks up a string key (hashed) in the SSTable.
-func (s *SSTable) Get(key string) (string, bool) {
-	h := HashStringToInt(key)
-	off, ok := s.index[h]
-	if !ok {
-		return "", false
+// readSection reads length bytes at off and checks them against the CRC32
+// stored right after them.
+func (s *SSTable) readSection(off, length int64) ([]byte, error) {
+	// Written so that no sum can overflow on the lengths of a damaged file.
+	if off < 0 || length < 0 || off > s.size-4 || length > s.size-off-4 {
+		return nil, fmt.Errorf("%w: section out of bounds", ErrCorruptSSTable)
 	}
-	if _, err := s.file.Seek(off, 0); err != nil {
-		return "", false
+	buf := make([]byte, length+4)
+	if _, err := s.file.ReadAt(buf, off); err != nil {
+		return nil, err
 	}
-	reader := bufio.NewReader(s.file)
-	line, err := reader.ReadString('\n')
+	data := buf[:length]
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(buf[length:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptSSTable, off)
+	}
+	return data, nil
+}
+
+// readBlock reads and decodes the i-th data block.
+func (s *SSTable) readBlock(i int) ([]kvEntry, error) {
+	h := s.blocks[i]
+	data, err := s.readSection(h.offset, h.length)
 	if err != nil {
-		return "", false
+		return nil, err
 	}
-	line = strings.TrimRight(line, "\n")
-	parts := strings.SplitN(line, "\t", 2)
-	if len(parts) != 2 {
-		return "", false
+	if data, err = s.compression.Decompress(data); err != nil {
+		return nil, fmt.Errorf("%w: block at offset %d: %v", ErrCorruptSSTable, h.offset, err)
+	}
+	return decodeBlock(data)
+}
+
+// findBlock returns the index of the first block whose last key is >= key.
+func (s *SSTable) findBlock(key string) int {
+	return sort.Search(len(s.blocks), func(i int) bool { return s.blocks[i].lastKey >= key })
+}
+
+// Get looks up a string key in the SSTable. Deleted keys are reported as
+// not found.
+func (s *SSTable) Get(key string) (string, bool, error) {
+	val, deleted, found, err := s.Lookup(key)
+	if err != nil || !found || deleted {
+		return "", false, err
+	}
+	return val, true, nil
+}
+
+// Lookup looks up a string key in the SSTable. found reports whether the
+// table holds a record for the key at all; deleted reports whether that
+// record is a tombstone or has expired, in which case callers must not fall
+// through to older data. A block that fails its checksum yields
+// ErrCorruptSSTable, since what it held is unknown.
+func (s *SSTable) Lookup(key string) (val string, deleted, found bool, err error) {
+	e, ok, err := s.lookup(key)
+	if err != nil || !ok {
+		return "", false, false, err
+	}
+	if !e.live(wallClock()) {
+		return "", true, true, nil
+	}
+	return *e.val, false, true, nil
+}
+
+// lookup consults the Bloom filter and then reads the single block that may
+// hold key.
+func (s *SSTable) lookup(key string) (kvEntry, bool, error) {
+	if s.filter != nil {
+		s.filterStats.checks.Add(1)
+		if !s.filter.mayContain(key) {
+			s.filterStats.negatives.Add(1)
+			return kvEntry{}, false, nil
+		}
+	}
+
+	e, ok, err := s.searchBlocks(key)
+	if err == nil && !ok && s.filter != nil {
+		s.filterStats.falsePositives.Add(1)
+	}
+	return e, ok, err
+}
+
+func (s *SSTable) searchBlocks(key string) (kvEntry, bool, error) {
+	i := s.findBlock(key)
+	if i == len(s.blocks) {
+		return kvEntry{}, false, nil
+	}
+	entries, err := s.readBlock(i)
+	if err != nil {
+		return kvEntry{}, false, err
+	}
+	j := sort.Search(len(entries), func(j int) bool { return entries[j].key >= key })
+	if j == len(entries) || entries[j].key != key {
+		return kvEntry{}, false, nil
+	}
+	return entries[j], true, nil
+}
+
+// FilterStats reports how the table's Bloom filter has performed so far.
+func (s *SSTable) FilterStats() FilterStats {
+	return s.filterStats.snapshot()
+}
+
+// mayContain reports whether key falls inside the table's key range.
+func (s *SSTable) mayContain(key string) bool {
+	return s.keys > 0 && key >= s.minKey && key <= s.maxKey
+}
+
+// overlaps reports whether the table's key range intersects [lo, hi].
+func (s *SSTable) overlaps(lo, hi string) bool {
+	return s.keys > 0 && s.minKey <= hi && lo <= s.maxKey
+}
+
+func (s *SSTable) ref() {
+	s.refs.Add(1)
+}
+
+// unref drops a reference, closing the table once none are left.
+func (s *SSTable) unref() {
+	if s.refs.Add(-1) == 0 {
+		_ = s.Close()
+		if s.obsolete.Load() {
+			_ = s.fs.Remove(s.path)
+		}
 	}
-	return parts[1], true
 }
 
 // Close releases the SSTable file handle.
@@ -141,3 +449,220 @@ func (s *SSTable) Close() error {
 	}
 	return nil
 }
+
+// appendRecord encodes one record onto a data block.
+func appendRecord(block []byte, e kvEntry) []byte {
+	var flags byte
+	var v string
+	if e.val == nil {
+		flags |= recordFlagTombstone
+	} else {
+		v = *e.val
+	}
+	if e.seq > 0 {
+		flags |= recordFlagSeq
+	}
+	if e.expires != 0 && e.val != nil {
+		flags |= recordFlagExpiry
+	}
+	block = append(block, flags)
+	block = binary.AppendUvarint(block, uint64(len(e.key)))
+	block = binary.AppendUvarint(block, uint64(len(v)))
+	if flags&recordFlagSeq != 0 {
+		block = binary.AppendUvarint(block, uint64(e.seq))
+	}
+	if flags&recordFlagExpiry != 0 {
+		block = binary.AppendVarint(block, e.expires)
+	}
+	block = append(block, e.key...)
+	return append(block, v...)
+}
+
+// decodeBlock decodes every record of a data block.
+func decodeBlock(data []byte) ([]kvEntry, error) {
+	var entries []kvEntry
+	for len(data) > 0 {
+		flags := data[0]
+		data = data[1:]
+		keyLen, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad record key length", ErrCorruptSSTable)
+		}
+		data = data[n:]
+		valLen, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad record value length", ErrCorruptSSTable)
+		}
+		data = data[n:]
+		var seq uint64
+		if flags&recordFlagSeq != 0 {
+			if seq, n = binary.Uvarint(data); n <= 0 {
+				return nil, fmt.Errorf("%w: bad record sequence number", ErrCorruptSSTable)
+			}
+			data = data[n:]
+		}
+		var expires int64
+		if flags&recordFlagExpiry != 0 {
+			if expires, n = binary.Varint(data); n <= 0 {
+				return nil, fmt.Errorf("%w: bad record expiry", ErrCorruptSSTable)
+			}
+			data = data[n:]
+		}
+		if keyLen > uint64(len(data)) || valLen > uint64(len(data))-keyLen {
+			return nil, fmt.Errorf("%w: truncated record", ErrCorruptSSTable)
+		}
+
+		e := kvEntry{key: string(data[:keyLen]), seq: int64(seq), expires: expires}
+		if flags&recordFlagTombstone == 0 {
+			v := string(data[keyLen : keyLen+valLen])
+			e.val = &v
+		}
+		entries = append(entries, e)
+		data = data[keyLen+valLen:]
+	}
+	return entries, nil
+}
+
+func encodeIndex(blocks []blockHandle) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(blocks)))
+	for _, b := range blocks {
+		buf = appendBytes(buf, []byte(b.lastKey))
+		buf = binary.AppendUvarint(buf, uint64(b.offset))
+		buf = binary.AppendUvarint(buf, uint64(b.length))
+	}
+	return buf
+}
+
+func decodeIndex(data []byte) ([]blockHandle, error) {
+	r := &byteReader{data: data}
+	n := r.uvarint()
+	if n > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: index: bad block count", ErrCorruptSSTable)
+	}
+	blocks := make([]blockHandle, n)
+	for i := range blocks {
+		blocks[i].lastKey = string(r.bytes())
+		blocks[i].offset = int64(r.uvarint())
+		blocks[i].length = int64(r.uvarint())
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: index: %v", ErrCorruptSSTable, r.err)
+	}
+	return blocks, nil
+}
+
+// properties returns the metadata section of the table.
+func (s *SSTable) properties() map[string][]byte {
+	props := map[string][]byte{
+		"keys":    binary.AppendUvarint(nil, uint64(s.keys)),
+		"min_key": []byte(s.minKey),
+		"max_key": []byte(s.maxKey),
+	}
+	if s.filter != nil {
+		props["filter"] = s.filter.encode()
+	}
+	if s.compression.ID() != NoCompression.ID() {
+		props["compression"] = []byte{s.compression.ID()}
+	}
+	return props
+}
+
+// setProperties restores table fields from the metadata section.
+func (s *SSTable) setProperties(props map[string][]byte) error {
+	keys, n := binary.Uvarint(props["keys"])
+	if n <= 0 {
+		return fmt.Errorf("%w: missing key count", ErrCorruptSSTable)
+	}
+	s.keys = int(keys)
+	s.minKey = string(props["min_key"])
+	s.maxKey = string(props["max_key"])
+	if data, ok := props["filter"]; ok {
+		f, err := decodeBloomFilter(data)
+		if err != nil {
+			return err
+		}
+		s.filter = f
+	}
+	if data, ok := props["compression"]; ok {
+		if len(data) != 1 {
+			return fmt.Errorf("%w: bad compression property", ErrCorruptSSTable)
+		}
+		c, err := compressionByID(data[0])
+		if err != nil {
+			return err
+		}
+		s.compression = c
+	}
+	return nil
+}
+
+// encodeProperties writes properties sorted by name so the output is
+// deterministic.
+func encodeProperties(props map[string][]byte) []byte {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := binary.AppendUvarint(nil, uint64(len(names)))
+	for _, name := range names {
+		buf = appendBytes(buf, []byte(name))
+		buf = appendBytes(buf, props[name])
+	}
+	return buf
+}
+
+func decodeProperties(data []byte) (map[string][]byte, error) {
+	r := &byteReader{data: data}
+	n := r.uvarint()
+	props := make(map[string][]byte, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		name := string(r.bytes())
+		props[name] = r.bytes()
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrCorruptSSTable, r.err)
+	}
+	return props, nil
+}
+
+// appendBytes appends b prefixed with its uvarint length.
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// byteReader decodes uvarints and length-prefixed byte strings, remembering
+// the first error so callers can check once at the end.
+type byteReader struct {
+	data []byte
+	err  error
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errors.New("bad uvarint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *byteReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errors.New("truncated field")
+		return nil
+	}
+	b := bytes.Clone(r.data[:n])
+	r.data = r.data[n:]
+	return b
+}
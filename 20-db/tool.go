@@ -0,0 +1,760 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// toolUsage lists the subcommands of `go run ./20-db tool`.
+const toolUsage = `usage: tool <command> [-json] <dir>
+
+Inspects the files of a DB directory that no process has open. With -json
+the output is JSON: one object per line for wal, one document otherwise.
+
+commands:
+  wal <dir>                dump every WAL record with its sequence number
+  verify <dir|file.sst>... check SSTable checksums, key order and Bloom filters
+  stats <dir>              show the tables per level, their keys, sizes and key ranges, and the WAL
+  tree <dir>               dump the shape of the memtable the WAL rebuilds, or of a paged DB's B+ tree
+  repair [-dry-run] <dir>  cut the WAL at its first damaged record so the DB opens again`
+
+// runTool runs one inspection subcommand. Run it with
+// `go run ./20-db tool <command> [-json] <dir>`.
+func runTool(args []string) error {
+	if len(args) == 0 {
+		return errors.New(toolUsage)
+	}
+	cmd := args[0]
+	flags := flag.NewFlagSet("tool "+cmd, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	asJSON := flags.Bool("json", false, "print JSON")
+	dryRun := flags.Bool("dry-run", false, "only report what repair would do")
+	if err := flags.Parse(args[1:]); err != nil {
+		return fmt.Errorf("%v\n%s", err, toolUsage)
+	}
+	out := toolOutput{json: *asJSON, w: os.Stdout}
+	if cmd == "verify" && flags.NArg() > 0 {
+		return toolVerify(out, flags.Args())
+	}
+	if flags.NArg() != 1 {
+		return errors.New(toolUsage)
+	}
+	dir := flags.Arg(0)
+	if info, err := statFile(OSFS, dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	switch cmd {
+	case "wal":
+		return toolDumpWAL(out, dir)
+	case "stats":
+		return toolStats(out, dir)
+	case "tree":
+		return toolTree(out, dir)
+	case "repair":
+		return toolRepair(out, dir, *dryRun)
+	}
+	return fmt.Errorf("unknown tool command %q\n%s", cmd, toolUsage)
+}
+
+// toolOutput prints either text or JSON.
+type toolOutput struct {
+	json bool
+	w    io.Writer
+}
+
+// emit prints v as one line of JSON.
+func (o toolOutput) emit(v any) error {
+	return json.NewEncoder(o.w).Encode(v)
+}
+
+// toolDB reads the manifest of the DB in dir without opening, and so
+// changing, the DB.
+func toolDB(dir string) (*KDB, *manifestState, error) {
+	db := &KDB{dir: dir, opts: Options{}.withDefaults(), now: wallClock}
+	db.wal = &WAL{filePath: filepath.Join(dir, walFile), opts: db.opts.WAL}
+	state, err := db.readManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, state, nil
+}
+
+// liveSegments returns the WAL segments of db the manifest has not marked
+// obsolete; Open would delete the others.
+func liveSegments(db *KDB, s *manifestState) ([]int, error) {
+	segments, err := db.wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	var live []int
+	for _, n := range segments {
+		if n >= s.logNumber {
+			live = append(live, n)
+		}
+	}
+	return live, nil
+}
+
+// toolWALRecord is a record, or a damaged stretch, in the wal dump.
+type toolWALRecord struct {
+	Segment string `json:"segment"`
+	Offset  int    `json:"offset"`
+	*WALOperation
+	Error string `json:"error,omitempty"`
+}
+
+func toolDumpWAL(out toolOutput, dir string) error {
+	db, state, err := toolDB(dir)
+	if err != nil {
+		return err
+	}
+	segments, err := liveSegments(db, state)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		path := db.wal.segmentPath(n)
+		name := filepath.Base(path)
+		data, err := OSFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !out.json {
+			fmt.Fprintf(out.w, "%s (%d bytes)\n", name, len(data))
+		}
+		var emitErr error
+		codec, err := segmentCodec(data)
+		if err != nil {
+			if out.json {
+				emitErr = out.emit(toolWALRecord{Segment: name, Error: err.Error()})
+			} else {
+				fmt.Fprintf(out.w, "  damaged: %v\n", err)
+			}
+			if emitErr != nil {
+				return emitErr
+			}
+			continue
+		}
+		walkRecords(data, codec, func(off, _ int, op WALOperation, err error) bool {
+			rec := toolWALRecord{Segment: name, Offset: off, WALOperation: &op}
+			if err != nil {
+				rec.WALOperation, rec.Error = nil, err.Error()
+			}
+			switch {
+			case out.json:
+				emitErr = out.emit(rec)
+			case err != nil:
+				fmt.Fprintf(out.w, "  @%d damaged: %v\n", off, err)
+			default:
+				fmt.Fprintf(out.w, "  @%d seq %d %s %s\n", off, op.Seq,
+					time.Unix(0, op.Timestamp).UTC().Format(time.RFC3339Nano), describeOp(op))
+				for _, sub := range op.Batch {
+					fmt.Fprintf(out.w, "      %s\n", describeOp(sub))
+				}
+			}
+			return emitErr == nil
+		})
+		if emitErr != nil {
+			return emitErr
+		}
+	}
+	return nil
+}
+
+// describeOp renders a WAL operation on one line, cutting long values.
+func describeOp(op WALOperation) string {
+	switch op.Operation {
+	case opBatch:
+		return fmt.Sprintf("BATCH of %d", len(op.Batch))
+	case opDelete:
+		return fmt.Sprintf("DELETE %q", op.Key)
+	}
+	s := fmt.Sprintf("PUT %q = %s", op.Key, clipValue(op.Value))
+	if op.ExpiresAt != 0 {
+		s += " expires " + time.Unix(0, op.ExpiresAt).UTC().Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+func clipValue(v string) string {
+	if len(v) > 64 {
+		return strconv.Quote(v[:64]) + fmt.Sprintf("... (%d bytes)", len(v))
+	}
+	return strconv.Quote(v)
+}
+
+// tableCheck is the verdict of verify on one SSTable.
+type tableCheck struct {
+	File     string   `json:"file"`
+	Blocks   int      `json:"blocks"`
+	Records  int      `json:"records"`
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// toolVerify checks the given SSTables, and every table in the given
+// directories.
+func toolVerify(out toolOutput, paths []string) error {
+	var files []string
+	for _, p := range paths {
+		info, err := statFile(OSFS, p)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		names, err := OSFS.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, ".sst") {
+				files = append(files, filepath.Join(p, name))
+			}
+		}
+	}
+
+	var checks []tableCheck
+	failed := 0
+	for _, f := range files {
+		c := verifyTable(f)
+		if !c.OK {
+			failed++
+		}
+		checks = append(checks, c)
+	}
+	if out.json {
+		if err := out.emit(map[string]any{"tables": checks, "failed": failed}); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range checks {
+			verdict := "ok"
+			if !c.OK {
+				verdict = "FAILED"
+			}
+			fmt.Fprintf(out.w, "%s: %s, %d blocks, %d records\n", c.File, verdict, c.Blocks, c.Records)
+			for _, p := range c.Problems {
+				fmt.Fprintf(out.w, "  %s\n", p)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tables failed verification", failed, len(checks))
+	}
+	return nil
+}
+
+// verifyTable reads every block of the table at path, which checks its
+// CRC, and checks that keys ascend strictly within and across blocks, that
+// each block ends with the key the index says, that the metadata matches
+// the records and that the Bloom filter admits every key.
+func verifyTable(path string) tableCheck {
+	c := tableCheck{File: path}
+	problem := func(format string, args ...any) {
+		c.Problems = append(c.Problems, fmt.Sprintf(format, args...))
+	}
+	t, err := LoadSSTable(path)
+	if err != nil {
+		problem("%v", err)
+		return c
+	}
+	defer t.Close()
+	c.Blocks = len(t.blocks)
+
+	// prev is the key the next record must sort after: the last one read,
+	// or the index's last key of a block that could not be.
+	var prev, first, last string
+	havePrev := false
+	for i, h := range t.blocks {
+		entries, err := t.readBlock(i)
+		if err == nil && len(entries) == 0 {
+			err = fmt.Errorf("empty block at offset %d", h.offset)
+		}
+		if err != nil {
+			problem("block %d: %v", i, err)
+			prev, havePrev = h.lastKey, true
+			continue
+		}
+		for _, e := range entries {
+			if havePrev && e.key <= prev {
+				problem("block %d: key %q does not sort after %q", i, e.key, prev)
+			}
+			if c.Records == 0 {
+				first = e.key
+			}
+			if t.filter != nil && !t.filter.mayContain(e.key) {
+				problem("block %d: Bloom filter rejects key %q", i, e.key)
+			}
+			prev, last, havePrev = e.key, e.key, true
+			c.Records++
+		}
+		if last != h.lastKey {
+			problem("block %d ends with %q, index says %q", i, last, h.lastKey)
+		}
+	}
+	if c.Records != t.keys {
+		problem("metadata counts %d keys, blocks hold %d", t.keys, c.Records)
+	}
+	if c.Records > 0 && (first != t.minKey || last != t.maxKey) {
+		problem("metadata key range [%q .. %q], records span [%q .. %q]", t.minKey, t.maxKey, first, last)
+	}
+	c.OK = len(c.Problems) == 0
+	return c
+}
+
+// dbStats is the output of stats.
+type dbStats struct {
+	Dir       string       `json:"dir"`
+	Manifest  int          `json:"manifest"`
+	LogNumber int          `json:"log_number"`
+	NextTable int          `json:"next_table"`
+	Levels    []levelStats `json:"levels"`
+	Tables    []tableStats `json:"tables"`
+	Orphans   []string     `json:"orphans,omitempty"`
+	WAL       walStats     `json:"wal"`
+}
+
+type levelStats struct {
+	Level  int   `json:"level"`
+	Tables int   `json:"tables"`
+	Keys   int   `json:"keys"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type tableStats struct {
+	File        string `json:"file"`
+	Level       int    `json:"level"`
+	Keys        int    `json:"keys"`
+	Bytes       int64  `json:"bytes"`
+	Blocks      int    `json:"blocks"`
+	MinKey      string `json:"min_key"`
+	MaxKey      string `json:"max_key"`
+	Compression string `json:"compression"`
+	Filter      bool   `json:"bloom_filter"`
+}
+
+type walStats struct {
+	Segments int   `json:"segments"`
+	Bytes    int64 `json:"bytes"`
+	Records  int   `json:"records"`
+	Damaged  int   `json:"damaged"`
+	FirstSeq int64 `json:"first_seq,omitempty"`
+	LastSeq  int64 `json:"last_seq,omitempty"`
+}
+
+func toolStats(out toolOutput, dir string) error {
+	db, state, err := toolDB(dir)
+	if err != nil {
+		return err
+	}
+	st := dbStats{Dir: dir, Manifest: state.num, LogNumber: state.logNumber, NextTable: state.nextTable}
+	for level, nums := range state.levels {
+		if len(nums) == 0 {
+			continue
+		}
+		ls := levelStats{Level: level, Tables: len(nums)}
+		for _, num := range nums {
+			t, err := LoadSSTable(db.tablePath(num))
+			if err != nil {
+				return err
+			}
+			ts := tableStats{
+				File: filepath.Base(t.path), Level: level, Keys: t.keys, Bytes: t.size, Blocks: len(t.blocks),
+				MinKey: t.minKey, MaxKey: t.maxKey, Compression: t.compression.Name(), Filter: t.filter != nil,
+			}
+			t.Close()
+			ls.Keys += ts.Keys
+			ls.Bytes += ts.Bytes
+			st.Tables = append(st.Tables, ts)
+		}
+		st.Levels = append(st.Levels, ls)
+	}
+
+	names, err := OSFS.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		num, err := strconv.Atoi(strings.TrimSuffix(name, ".sst"))
+		if strings.HasSuffix(name, ".sst") && err == nil && !state.live(num) {
+			st.Orphans = append(st.Orphans, name)
+		}
+	}
+
+	segments, err := liveSegments(db, state)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		data, err := OSFS.ReadFile(db.wal.segmentPath(n))
+		if err != nil {
+			return err
+		}
+		st.WAL.Segments++
+		st.WAL.Bytes += int64(len(data))
+		codec, err := segmentCodec(data)
+		if err != nil {
+			st.WAL.Damaged++
+			continue
+		}
+		walkRecords(data, codec, func(_, _ int, op WALOperation, err error) bool {
+			if err != nil {
+				st.WAL.Damaged++
+				return true
+			}
+			if st.WAL.Records == 0 {
+				st.WAL.FirstSeq = op.Seq
+			}
+			st.WAL.LastSeq = op.Seq
+			st.WAL.Records++
+			return true
+		})
+	}
+
+	if out.json {
+		return out.emit(st)
+	}
+	fmt.Fprintf(out.w, "%s: manifest %d, log number %d, next table %d\n", dir, st.Manifest, st.LogNumber, st.NextTable)
+	tw := tabwriter.NewWriter(out.w, 0, 4, 2, ' ', 0)
+	for _, ls := range st.Levels {
+		fmt.Fprintf(tw, "L%d\t%d tables\t%d keys\t%d bytes\n", ls.Level, ls.Tables, ls.Keys, ls.Bytes)
+	}
+	for _, ts := range st.Tables {
+		fmt.Fprintf(tw, "  %s\tL%d\t%d keys\t%d bytes\t%d blocks\t%s\t[%q .. %q]\n",
+			ts.File, ts.Level, ts.Keys, ts.Bytes, ts.Blocks, ts.Compression, ts.MinKey, ts.MaxKey)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(st.Orphans) > 0 {
+		fmt.Fprintf(out.w, "orphaned tables: %s\n", strings.Join(st.Orphans, ", "))
+	}
+	fmt.Fprintf(out.w, "WAL: %d segments, %d bytes, %d records", st.WAL.Segments, st.WAL.Bytes, st.WAL.Records)
+	if st.WAL.Records > 0 {
+		fmt.Fprintf(out.w, ", seq %d .. %d", st.WAL.FirstSeq, st.WAL.LastSeq)
+	}
+	if st.WAL.Damaged > 0 {
+		fmt.Fprintf(out.w, ", %d damaged", st.WAL.Damaged)
+	}
+	fmt.Fprintln(out.w)
+	return nil
+}
+
+// treeNode is one node in the tree dump.
+type treeNode struct {
+	Keys     []string    `json:"keys"`
+	Children []*treeNode `json:"children,omitempty"`
+}
+
+// treeShape is the output of tree.
+type treeShape struct {
+	Kind   string      `json:"kind"` // "memtable" or "bplustree"
+	Depth  int         `json:"depth"`
+	Levels []treeLevel `json:"levels"` // from the root down
+	Root   *treeNode   `json:"root,omitempty"`
+}
+
+type treeLevel struct {
+	Nodes int `json:"nodes"`
+	Keys  int `json:"keys"`
+}
+
+func toolTree(out toolOutput, dir string) error {
+	var shape treeShape
+	var err error
+	if _, statErr := statFile(OSFS, filepath.Join(dir, pagedFile)); statErr == nil {
+		shape, err = pagedTreeShape(filepath.Join(dir, pagedFile))
+	} else {
+		shape, err = memtableShape(dir)
+	}
+	if err != nil {
+		return err
+	}
+	var count func(n *treeNode, depth int)
+	count = func(n *treeNode, depth int) {
+		if depth == len(shape.Levels) {
+			shape.Levels = append(shape.Levels, treeLevel{})
+		}
+		shape.Levels[depth].Nodes++
+		shape.Levels[depth].Keys += len(n.Keys)
+		for _, c := range n.Children {
+			count(c, depth+1)
+		}
+	}
+	if shape.Root != nil {
+		count(shape.Root, 0)
+	}
+	shape.Depth = len(shape.Levels)
+
+	if out.json {
+		return out.emit(shape)
+	}
+	fmt.Fprintf(out.w, "%s, depth %d\n", shape.Kind, shape.Depth)
+	for depth, l := range shape.Levels {
+		fmt.Fprintf(out.w, "  level %d: %d nodes, %d keys, %.1f keys per node\n",
+			depth, l.Nodes, l.Keys, float64(l.Keys)/float64(l.Nodes))
+	}
+	var dump func(n *treeNode, indent string)
+	dump = func(n *treeNode, indent string) {
+		switch len(n.Keys) {
+		case 0:
+			fmt.Fprintf(out.w, "%s[]\n", indent)
+		case 1:
+			fmt.Fprintf(out.w, "%s[%q]\n", indent, n.Keys[0])
+		default:
+			fmt.Fprintf(out.w, "%s[%q .. %q] %d keys\n", indent, n.Keys[0], n.Keys[len(n.Keys)-1], len(n.Keys))
+		}
+		for _, c := range n.Children {
+			dump(c, indent+"  ")
+		}
+	}
+	if shape.Root != nil {
+		dump(shape.Root, "")
+	}
+	return nil
+}
+
+// memtableShape rebuilds the memtable from the live WAL segments, as Open
+// would, and returns the shape of its B-tree.
+func memtableShape(dir string) (treeShape, error) {
+	db, state, err := toolDB(dir)
+	if err != nil {
+		return treeShape{}, err
+	}
+	segments, err := liveSegments(db, state)
+	if err != nil {
+		return treeShape{}, err
+	}
+	for _, n := range segments {
+		data, err := OSFS.ReadFile(db.wal.segmentPath(n))
+		if err != nil {
+			return treeShape{}, err
+		}
+		codec, err := segmentCodec(data)
+		if err != nil {
+			continue
+		}
+		// Damaged records are skipped, as WAL.Recover does.
+		walkRecords(data, codec, func(_, _ int, op WALOperation, err error) bool {
+			if err == nil {
+				db.applyOp(op)
+			}
+			return true
+		})
+	}
+
+	var walk func(n *Node) *treeNode
+	walk = func(n *Node) *treeNode {
+		tn := &treeNode{Keys: []string{n.key1, n.key2, n.key3}[:n.size]}
+		for _, c := range []*Node{n.cp1, n.cp2, n.cp3, n.cp4} {
+			if c != nil {
+				tn.Children = append(tn.Children, walk(c))
+			}
+		}
+		return tn
+	}
+	shape := treeShape{Kind: "memtable"}
+	if db.head != nil {
+		shape.Root = walk(db.head)
+	}
+	return shape, nil
+}
+
+// pagedTreeShape returns the shape of the B+ tree in the page file at path.
+func pagedTreeShape(path string) (treeShape, error) {
+	t, err := OpenBPlusTree(path, PagedOptions{})
+	if err != nil {
+		return treeShape{}, err
+	}
+	defer t.Close()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var walk func(id uint32) (*treeNode, error)
+	walk = func(id uint32) (*treeNode, error) {
+		n, err := t.readNode(id)
+		if err != nil {
+			return nil, err
+		}
+		tn := &treeNode{Keys: n.keys}
+		for _, kid := range n.kids {
+			c, err := walk(kid)
+			if err != nil {
+				return nil, err
+			}
+			tn.Children = append(tn.Children, c)
+		}
+		return tn, nil
+	}
+	root, err := walk(t.pager.root)
+	if err != nil {
+		return treeShape{}, err
+	}
+	return treeShape{Kind: "bplustree", Root: root}, nil
+}
+
+// repairReport is the output of repair.
+type repairReport struct {
+	Damaged        bool     `json:"damaged"`
+	Segment        string   `json:"segment,omitempty"`
+	Offset         int      `json:"offset,omitempty"`
+	Error          string   `json:"error,omitempty"`
+	TruncatedBytes int      `json:"truncated_bytes,omitempty"`
+	DroppedRecords int      `json:"dropped_records,omitempty"`
+	Removed        []string `json:"removed_segments,omitempty"`
+	NewSegment     string   `json:"new_segment,omitempty"`
+	NextSeq        int64    `json:"next_seq,omitempty"`
+	DryRun         bool     `json:"dry_run,omitempty"`
+}
+
+// toolRepair cuts the WAL at its first damaged record: the segment holding
+// it is truncated there and every later segment is removed. Valid records
+// after the damage are lost too, which is what opening with
+// RecoveryTolerateTail refuses to do on its own. A new empty segment then
+// carries on the sequence from the highest number seen, so no sequence
+// number a follower may already have applied is handed out again.
+func toolRepair(out toolOutput, dir string, dryRun bool) error {
+	// A KDB with the directory open would keep writing to the segment
+	// being cut, and its own state would no longer match the files.
+	lock, err := OSFS.Lock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return fmt.Errorf("repair needs the DB closed: %w", err)
+	}
+	defer lock.Close()
+	db, state, err := toolDB(dir)
+	if err != nil {
+		return err
+	}
+	segments, err := liveSegments(db, state)
+	if err != nil {
+		return err
+	}
+
+	r := repairReport{DryRun: dryRun}
+	cutSegment := -1
+	var maxSeq int64
+	for i, n := range segments {
+		data, err := OSFS.ReadFile(db.wal.segmentPath(n))
+		if err != nil {
+			return err
+		}
+		if len(data) >= walHeaderSize && binary.LittleEndian.Uint32(data) == walMagic {
+			maxSeq = max(maxSeq, int64(binary.LittleEndian.Uint64(data[8:]))-1)
+		}
+		if r.Damaged {
+			r.Removed = append(r.Removed, filepath.Base(db.wal.segmentPath(n)))
+			r.TruncatedBytes += len(data)
+		}
+		codec, err := segmentCodec(data)
+		if errors.Is(err, errBadSegmentHeader) {
+			if !r.Damaged {
+				r.Damaged, r.Offset, r.Error = true, 0, err.Error()
+				r.Segment = filepath.Base(db.wal.segmentPath(n))
+				r.TruncatedBytes = len(data)
+				cutSegment = i
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(db.wal.segmentPath(n)), err)
+		}
+		walkRecords(data, codec, func(off, _ int, op WALOperation, err error) bool {
+			if err == nil {
+				maxSeq = max(maxSeq, op.Seq)
+			}
+			switch {
+			case r.Damaged:
+				if err == nil {
+					r.DroppedRecords++
+				}
+			case err != nil:
+				r.Damaged, r.Offset, r.Error = true, off, err.Error()
+				r.Segment = filepath.Base(db.wal.segmentPath(n))
+				r.TruncatedBytes = len(data) - off
+				cutSegment = i
+			}
+			return true
+		})
+	}
+
+	if r.Damaged {
+		// A segment whose header is damaged goes entirely; an empty one
+		// anywhere but at the end would not open.
+		if r.Offset == 0 {
+			r.Removed = append([]string{r.Segment}, r.Removed...)
+		}
+		r.NewSegment = filepath.Base(db.wal.segmentPath(segments[len(segments)-1] + 1))
+		r.NextSeq = maxSeq + 1
+	}
+	if r.Damaged && !dryRun {
+		if r.Offset > 0 {
+			if err := truncateFile(OSFS, db.wal.segmentPath(segments[cutSegment]), int64(r.Offset)); err != nil {
+				return fmt.Errorf("truncate %s: %w", r.Segment, err)
+			}
+		}
+		for _, name := range r.Removed {
+			if err := OSFS.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+		// openSegment syncs the directory, which covers the removals too.
+		if err := db.wal.openSegment(segments[len(segments)-1]+1, r.NextSeq); err != nil {
+			return err
+		}
+		if err := db.wal.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	if out.json {
+		return out.emit(r)
+	}
+	switch {
+	case !r.Damaged:
+		fmt.Fprintln(out.w, "WAL is intact; nothing to repair")
+		return nil
+	case dryRun:
+		fmt.Fprint(out.w, "would cut ")
+	default:
+		fmt.Fprint(out.w, "cut ")
+	}
+	fmt.Fprintf(out.w, "%s at offset %d (%s): %d bytes and %d valid records after it dropped",
+		r.Segment, r.Offset, r.Error, r.TruncatedBytes, r.DroppedRecords)
+	if len(r.Removed) > 0 {
+		fmt.Fprintf(out.w, ", segments %s removed", strings.Join(r.Removed, ", "))
+	}
+	fmt.Fprintf(out.w, "; %s continues at seq %d\n", r.NewSegment, r.NextSeq)
+	return nil
+}
+
+// truncateFile cuts the file at path in fs to size and syncs it.
+func truncateFile(fs FS, path string, size int64) error {
+	f, err := fs.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultReapInterval is how often the reaper runs when Options leaves
+// ReapInterval unset.
+const defaultReapInterval = time.Second
+
+// ErrInvalidTTL is returned by PutWithTTL for a TTL that is not positive.
+var ErrInvalidTTL = errors.New("kdb: ttl must be positive")
+
+// PutWithTTL stores val under key until ttl has passed. From then on the key
+// reads as absent, exactly as if it had been deleted: it also hides older
+// values of the key. Expiry is lazy; the reaper and compaction reclaim the
+// space later. Overwriting the key with Put clears the TTL.
+func (db *KDB) PutWithTTL(key, val string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+	expires := db.now() + int64(ttl)
+	return db.apply(WALOperation{Operation: opPut, Key: key, Value: val, ExpiresAt: expires}, nil)
+}
+
+// wallClock is the default KDB clock: Unix time in nanoseconds, the unit
+// expiry times are stored in.
+func wallClock() int64 {
+	return time.Now().UnixNano()
+}
+
+// expired reports whether an entry with expiry time expires is past it at
+// now. Zero means the entry never expires.
+func expired(expires, now int64) bool {
+	return expires != 0 && expires <= now
+}
+
+// value turns a version into Get's result: tombstones and expired values
+// read as absent.
+func (v *version) value(now int64) (string, bool) {
+	if v.val == nil || expired(v.expires, now) {
+		return "", false
+	}
+	return *v.val, true
+}
+
+// live reports whether e holds a value that has not expired at now.
+func (e kvEntry) live(now int64) bool {
+	return e.val != nil && !expired(e.expires, now)
+}
+
+// ReapExpired deletes the keys whose value in the memtable has expired and
+// returns how many it reaped. Reads already treat those keys as absent, so
+// this only reclaims memory: the deletes are one logged batch at a fresh
+// sequence number, like any write, and the expired versions below them go
+// once no snapshot can read them. Versions are never changed in place,
+// since snapshots read them without the writer's locks. The background
+// reaper calls it every Options.ReapInterval; a follower leaves reaping to
+// its leader, whose deletes it replicates.
+func (db *KDB) ReapExpired() int {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.closed || db.readOnly {
+		return 0
+	}
+
+	now := db.now()
+	batch := WALOperation{Operation: opBatch}
+	db.mu.RLock()
+	db.forEachEntry(func(key string, v *version) {
+		if v.val != nil && expired(v.expires, now) {
+			batch.Batch = append(batch.Batch, WALOperation{Operation: opDelete, Key: key})
+		}
+	})
+	db.mu.RUnlock()
+	if len(batch.Batch) == 0 {
+		return 0
+	}
+	// A WAL failure sticks, so the next write reports it.
+	if _, err := db.logAndApply(batch); err != nil {
+		return 0
+	}
+	return len(batch.Batch)
+}
+
+// startReaper launches the goroutine that periodically reaps expired keys.
+func (db *KDB) startReaper() {
+	if db.opts.ReapInterval < 0 {
+		return
+	}
+	db.stopReap = make(chan struct{})
+	db.reapWG.Add(1)
+	go func() {
+		defer db.reapWG.Done()
+		ticker := time.NewTicker(db.opts.ReapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.stopReap:
+				return
+			case <-ticker.C:
+				db.ReapExpired()
+			}
+		}
+	}()
+}
+
+// stopReaper stops the reaper and waits for it to exit; calling it again
+// is a no-op. Callers must not hold db.writeMu, which a running reap takes.
+func (db *KDB) stopReaper() {
+	db.reapStopOnce.Do(func() {
+		if db.stopReap != nil {
+			close(db.stopReap)
+			db.reapWG.Wait()
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestTTL follows keys with a TTL through their life on a clock the test
+// moves: expiry on Get and on a snapshot taken before it, the reaper
+// running next to snapshot reads, WAL replay, an SSTable flush and a
+// compaction that drops them. Run it under the race detector:
+// `go test -race -run TTL ./20-db`.
+func TestTTL(t *testing.T) {
+	var clock atomic.Int64
+	clock.Store(time.Now().UnixNano())
+	tick := func(d time.Duration) { clock.Add(int64(d)) }
+
+	dir := t.TempDir()
+	// The reaper and the compactor start by hand once the clock is in.
+	opts := Options{ReapInterval: -1, Compaction: CompactionNone, L0CompactionTrigger: 2}
+	open := func() *KDB {
+		db, err := Open(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.now = clock.Load
+		return db
+	}
+	db := open()
+	check := func(get func(string) (string, bool, error), key string, want bool) {
+		t.Helper()
+		_, ok, err := get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("%s present %v, want %v", key, ok, want)
+		}
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := db.PutWithTTL(key, "short", 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutWithTTL("long", "x", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("keep", "x"); err != nil {
+		t.Fatal(err)
+	}
+	snap := db.Snapshot()
+	check(db.Get, "a", true)
+	check(snap.Get, "a", true)
+
+	// Expiry is wall-clock time, so the snapshot loses the keys too.
+	tick(11 * time.Second)
+	check(db.Get, "a", false)
+	check(snap.Get, "a", false)
+	check(snap.Get, "long", true)
+
+	// Snapshot readers race the reaper, which must not touch the versions
+	// they read.
+	db.opts.ReapInterval = time.Millisecond
+	db.startReaper()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, key := range []string{"a", "b", "long"} {
+					if _, ok, err := snap.Get(key); err != nil || ok != (key == "long") {
+						t.Errorf("snapshot read %s: present %v, %v", key, ok, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reaped(db, "a") || !reaped(db, "b") {
+		if time.Now().After(deadline) {
+			t.Fatal("reaper left the expired keys alone")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if reaped(db, "long") {
+		t.Fatal("reaper deleted a live key")
+	}
+	snap.Release()
+
+	// A TTL survives WAL replay...
+	if err := db.PutWithTTL("w", "x", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = open()
+	defer db.Close()
+	check(db.Get, "w", true)
+	check(db.Get, "a", false)
+	check(db.Get, "long", true)
+
+	// ...and a flush to an SSTable.
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	check(db.Get, "w", true)
+	tick(11 * time.Second)
+	check(db.Get, "w", false)
+
+	// A compaction after expiry leaves nothing of the expired keys behind.
+	db.opts.Compaction = CompactionLeveled
+	db.startCompactor()
+	if err := db.Put("filler", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		db.mu.RLock()
+		pending := len(db.levels[0])
+		db.mu.RUnlock()
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("level 0 never compacted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	found := make(map[string]bool)
+	db.mu.RLock()
+	for _, tb := range db.tablesNewestFirst() {
+		it := newRecordMerger([]recordIterator{newTableIterator(tb, IterOptions{})})
+		for ; it.Valid(); it.Next() {
+			found[it.entry().key] = true
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.mu.RUnlock()
+	for _, key := range []string{"a", "b", "w"} {
+		if found[key] {
+			t.Errorf("compaction kept a record of expired %s", key)
+		}
+	}
+	for _, key := range []string{"long", "keep", "filler"} {
+		if !found[key] {
+			t.Errorf("compaction lost %s", key)
+		}
+	}
+}
+
+// reaped reports whether the newest version of key in db's memtable is a
+// tombstone.
+func reaped(db *KDB, key string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	slot := db.valueSlot(key)
+	return slot != nil && (*slot).val == nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+var (
+	// ErrConflict is returned by Txn.Commit when another writer committed
+	// to a key in the transaction's write set after the transaction began.
+	// The transaction is rolled back; callers typically retry it.
+	ErrConflict = errors.New("kdb: transaction conflict")
+	// ErrTxnDone is returned when a transaction is used after Commit or
+	// Rollback.
+	ErrTxnDone = errors.New("kdb: transaction already finished")
+)
+
+// Txn is a snapshot-isolated transaction. Reads see the DB as of Begin plus
+// the transaction's own writes, which are buffered until Commit. Two
+// transactions that write the same key conflict: the first to commit wins
+// and the other gets ErrConflict. A Txn is not safe for concurrent use.
+type Txn struct {
+	db     *KDB
+	snap   *Snapshot
+	writes map[string]*string // nil value is a delete
+	done   bool
+}
+
+// Begin starts a transaction reading at the current sequence number. Its
+// snapshot keeps the versions it may read from being garbage collected
+// until the transaction finishes.
+func (db *KDB) Begin() *Txn {
+	return &Txn{db: db, snap: db.Snapshot(), writes: make(map[string]*string)}
+}
+
+// Get returns the value of key as seen by the transaction.
+func (t *Txn) Get(key string) (string, bool, error) {
+	if t.done {
+		return "", false, ErrTxnDone
+	}
+	if val, ok := t.writes[key]; ok {
+		v, ok := liveValue(val)
+		return v, ok, nil
+	}
+	return t.snap.Get(key)
+}
+
+// Put buffers a write of val under key.
+func (t *Txn) Put(key, val string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.writes[key] = &val
+	return nil
+}
+
+// Delete buffers a deletion of key.
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.writes[key] = nil
+	return nil
+}
+
+// Commit atomically applies the transaction's writes as one batch, tagged
+// with a single sequence number. It fails with ErrConflict if any written
+// key has a version newer than the transaction's snapshot. Either way the
+// transaction is finished afterwards.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	defer t.finish()
+	if len(t.writes) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(t.writes))
+	for key := range t.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	batch := WALOperation{Operation: opBatch}
+	for _, key := range keys {
+		if val := t.writes[key]; val != nil {
+			batch.Batch = append(batch.Batch, WALOperation{Operation: opPut, Key: key, Value: *val})
+		} else {
+			batch.Batch = append(batch.Batch, WALOperation{Operation: opDelete, Key: key})
+		}
+	}
+
+	// The check runs under the DB's writer lock, so no other commit can
+	// slip in between it and the batch being applied.
+	return t.db.apply(batch, func() error {
+		for _, key := range keys {
+			if t.db.latestSeq(key) > t.snap.seq {
+				return fmt.Errorf("%w: key %q", ErrConflict, key)
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback discards the transaction's writes. Rolling back a finished
+// transaction is a no-op, so it is safe to defer right after Begin.
+func (t *Txn) Rollback() {
+	if !t.done {
+		t.finish()
+	}
+}
+
+func (t *Txn) finish() {
+	t.done = true
+	t.writes = nil
+	t.snap.Release()
+}
+
+// latestSeq returns the sequence number of the newest write to key, or 0 if
+// there is none (or it predates sequence numbers in SSTables).
+func (db *KDB) latestSeq(key string) int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if slot := db.valueSlot(key); slot != nil {
+		return (*slot).seq
+	}
+	for _, t := range db.tablesNewestFirst() {
+		if !t.mayContain(key) {
+			continue
+		}
+		e, found, err := t.lookup(key)
+		if err != nil {
+			// Unreadable history could hide a newer write; assume one.
+			return math.MaxInt64
+		}
+		if found {
+			return e.seq
+		}
+	}
+	return 0
+}
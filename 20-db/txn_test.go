@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestTxnConflictSurvivesCompaction checks that a delete committed after a
+// transaction began still conflicts with it once compaction has merged the
+// delete's tombstone with the value it hides.
+func TestTxnConflictSurvivesCompaction(t *testing.T) {
+	db, err := Open(t.TempDir(), Options{Compaction: CompactionNone, MinMergeWidth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	txn := db.Begin()
+	defer txn.Rollback()
+	if err := db.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the merge by hand rather than racing the background compactor.
+	db.opts.Compaction = CompactionSizeTiered
+	if did, err := db.compactOnce(); err != nil || !did {
+		t.Fatalf("compaction: did %v, err %v", did, err)
+	}
+	if n := db.tableCount(); n != 1 {
+		t.Fatalf("%d tables after compaction, want 1", n)
+	}
+
+	if err := txn.Put("k", "w"); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("commit returned %v, want ErrConflict", err)
+	}
+	if _, _, err := txn.Get("k"); !errors.Is(err, ErrTxnDone) {
+		t.Fatalf("Get after commit returned %v, want ErrTxnDone", err)
+	}
+}
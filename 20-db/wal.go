@@ -1,141 +1,959 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// WAL operation names.
+const (
+	opPut    = "PUT"
+	opDelete = "DELETE"
+	opBatch  = "BATCH"
+)
+
 // WALOperation represents a single operation in the WAL.
-// Each entry is stored as one JSON line.
 type WALOperation struct {
 	Seq       int64  `json:"seq"`
-	Operation string `json:"op"` // "PUT" or "DELETE"
+	Operation string `json:"op"` // "PUT", "DELETE" or "BATCH"
 	Key       string `json:"key"`
 	Value     string `json:"value"`
 	Timestamp int64  `json:"timestamp"`
+	// ExpiresAt is when a PUT's value expires, in Unix nanoseconds; 0 means
+	// never.
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// Batch holds the PUT and DELETE operations of a BATCH record, which
+	// share its sequence number and timestamp.
+	Batch []WALOperation `json:"batch,omitempty"`
+}
+
+// The WAL is a series of segment files named "<path>.000001",
+// "<path>.000002", ... Each segment starts with a header
+//
+//	magic:4 | version:2 | flags:2 | baseSeq:8
+//
+// where baseSeq is the sequence number the segment's first record gets, so
+// the sequence survives truncation even when no records are left, and the
+// low byte of flags is the ID of the Compression the segment's payloads are
+// stored with. After the header come records:
+//
+//	length:4 | crc:4 | seq:8 | payload
+//
+// The CRC32 covers seq and the stored payload, and length is the stored
+// length. Once decompressed, the payload is
+//
+//	op:1 | uvarint keyLen | key | uvarint valLen | value | varint timestamp
+//
+// except for batches, whose payload is
+//
+//	op:1 | uvarint count | count × (op:1 | uvarint keyLen | key | uvarint valLen | value) | varint timestamp
+//
+// A PUT with a TTL, alone or in a batch, uses its own op code and carries
+// a varint expiry time right after its value.
+//
+// A batch is a single record under a single checksum, so recovery sees
+// either all of it or none of it.
+//
+// All fixed-size integers are little endian.
+const (
+	walMagic              uint32 = 0x4b57414c // "KWAL"
+	walVersion            uint16 = 1
+	walHeaderSize                = 16
+	walRecordHeaderSize          = 16
+	defaultWALSegmentSize        = 4 << 20
+
+	walOpPut    byte = 1
+	walOpDelete byte = 2
+	walOpBatch  byte = 3
+	walOpPutTTL byte = 4
+)
+
+// ErrWALCorrupt is returned when the WAL holds a record that fails its
+// checksum or cannot be decoded, and the recovery mode does not allow
+// skipping it.
+var ErrWALCorrupt = errors.New("kdb: corrupt WAL")
+
+// errWALTorn marks a record that runs past the end of its segment.
+var errWALTorn = errors.New("torn record")
+
+// RecoveryMode decides what opening a WAL does with damaged records.
+type RecoveryMode int
+
+const (
+	// RecoveryTolerateTail drops a damaged record at the very end of the log
+	// (a torn final write) and truncates it away, but refuses to open a log
+	// that is damaged anywhere else.
+	RecoveryTolerateTail RecoveryMode = iota
+	// RecoveryStrict refuses to open a log with any damaged record.
+	RecoveryStrict
+	// RecoverySkipCorrupt skips damaged records wherever they are and
+	// replays everything that still checks out.
+	RecoverySkipCorrupt
+)
+
+func (m RecoveryMode) String() string {
+	switch m {
+	case RecoveryTolerateTail:
+		return "tolerate-tail"
+	case RecoveryStrict:
+		return "strict"
+	case RecoverySkipCorrupt:
+		return "skip-corrupt"
+	}
+	return fmt.Sprintf("RecoveryMode(%d)", int(m))
 }
 
-// WAL is a simple write-ahead log.
+// SyncPolicy decides when WAL writes are fsynced to disk.
+type SyncPolicy int
+
+const (
+	// SyncEveryWrite fsyncs each record before the write returns.
+	SyncEveryWrite SyncPolicy = iota
+	// SyncGroupCommit also makes each record durable before the write
+	// returns, but concurrent writers share fsyncs: whoever syncs first
+	// covers every record appended so far.
+	SyncGroupCommit
+	// SyncInterval fsyncs in the background every WALOptions.SyncInterval.
+	// A crash can lose the writes of the last interval.
+	SyncInterval
+	// SyncNone leaves flushing to the OS and only fsyncs on rotation and
+	// Close. A crash of the machine can lose any unsynced write.
+	SyncNone
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncEveryWrite:
+		return "every-write"
+	case SyncGroupCommit:
+		return "group-commit"
+	case SyncInterval:
+		return "interval"
+	case SyncNone:
+		return "none"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// defaultSyncInterval is used by SyncInterval when no interval is given.
+const defaultSyncInterval = 10 * time.Millisecond
+
+// WALOptions tunes a WAL opened with NewWAL.
+type WALOptions struct {
+	// SegmentSize is the size at which the active segment is closed and a
+	// new one started.
+	SegmentSize int64
+	// Recovery selects how damaged records are handled on open.
+	Recovery RecoveryMode
+	// Sync selects the durability policy for writes.
+	Sync SyncPolicy
+	// SyncInterval is the fsync period under SyncInterval.
+	SyncInterval time.Duration
+	// Compression compresses the payload of every record in new segments.
+	// Records are compressed one by one, so this only pays off for large
+	// values. Nil means NoCompression.
+	Compression Compression
+	// FS is the file system the segments live on. Nil means OSFS.
+	FS FS
+}
+
+func (o WALOptions) withDefaults() WALOptions {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = defaultWALSegmentSize
+	}
+	if o.SyncInterval <= 0 {
+		o.SyncInterval = defaultSyncInterval
+	}
+	if o.Compression == nil {
+		o.Compression = NoCompression
+	}
+	if o.FS == nil {
+		o.FS = OSFS
+	}
+	return o
+}
+
+// RecoveryReport describes what opening the WAL found on disk.
+type RecoveryReport struct {
+	Segments       int   // segment files read
+	Records        int   // valid records found
+	CorruptRecords int   // damaged records skipped (RecoverySkipCorrupt)
+	SkippedBytes   int64 // bytes skipped over damaged records
+	TruncatedBytes int64 // bytes cut from a torn tail
+}
+
+// WAL is a segmented, checksummed write-ahead log.
+//
+// A write that fails part way is cut off the active segment again. If
+// that fails too, or an fsync fails, what the segment holds is no longer
+// known, so the WAL refuses every later write with the same error; only
+// reopening it, which reads the segments back, recovers.
 type WAL struct {
-	file     *os.File
+	file     File // active segment
 	mu       sync.Mutex
 	seq      int64
-	filePath string
+	filePath string // segment files are named filePath + ".NNNNNN"
+	opts     WALOptions
+	segment  int         // number of the active segment
+	size     int64       // bytes written to the active segment
+	codec    Compression // codec of the active segment
+	report   RecoveryReport
+	failed   error // set once the active segment is in an unknown state
+
+	syncMu    sync.Mutex // serialises group-commit leaders
+	syncedSeq int64      // highest seq known to be on stable storage
+	stopSync  chan struct{}
+	syncDone  sync.WaitGroup
 }
 
-func NewWAL(filePath string) (*WAL, error) {
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// NewWAL opens the WAL rooted at filePath. Existing segments are scanned
+// according to opts.Recovery, a torn tail is truncated away, and the last
+// segment is reopened for appending.
+func NewWAL(filePath string, opts WALOptions) (*WAL, error) {
+	w := &WAL{filePath: filePath, opts: opts.withDefaults()}
+
+	segments, err := w.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		if err := w.openSegment(1, 1); err != nil {
+			return nil, err
+		}
+		w.startSyncer()
+		return w, nil
+	}
+
+	var lastGood int64
+	for i, n := range segments {
+		scan, err := w.scanSegment(n, i == len(segments)-1)
+		if err != nil {
+			return nil, err
+		}
+		if scan.goodSize > 0 {
+			w.seq = scan.lastSeq
+		}
+		lastGood = scan.goodSize
+		w.codec = scan.codec
+		w.report.Segments++
+		w.report.Records += len(scan.ops)
+		w.report.CorruptRecords += scan.corrupt
+		w.report.SkippedBytes += scan.skipped
+		w.report.TruncatedBytes += scan.truncated
+	}
+
+	last := segments[len(segments)-1]
+	if lastGood == 0 {
+		// The last segment lost its header; start it over.
+		if err := w.openSegment(last, w.seq+1); err != nil {
+			return nil, err
+		}
+		w.syncedSeq = w.seq
+		w.startSyncer()
+		return w, nil
+	}
+	file, err := w.opts.FS.OpenFile(w.segmentPath(last), os.O_RDWR, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
 	}
+	if w.report.TruncatedBytes > 0 {
+		// Cut the torn tail so new records are not appended after garbage.
+		if err := file.Truncate(lastGood); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate torn WAL tail: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to sync WAL: %w", err)
+		}
+	}
+	if _, err := file.Seek(lastGood, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek WAL: %w", err)
+	}
+	w.file, w.segment, w.size = file, last, lastGood
+	w.syncedSeq = w.seq
+	w.startSyncer()
+	return w, nil
+}
+
+// startSyncer launches the background fsync loop used by SyncInterval.
+func (w *WAL) startSyncer() {
+	if w.opts.Sync != SyncInterval {
+		return
+	}
+	w.stopSync = make(chan struct{})
+	w.syncDone.Add(1)
+	go func() {
+		defer w.syncDone.Done()
+		ticker := time.NewTicker(w.opts.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stopSync:
+				return
+			case <-ticker.C:
+				w.mu.Lock()
+				if w.syncedSeq < w.seq {
+					_ = w.syncLocked()
+				}
+				w.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// syncLocked fsyncs the active segment. Callers hold w.mu.
+func (w *WAL) syncLocked() error {
+	if w.failed != nil {
+		return w.failed
+	}
+	if err := w.file.Sync(); err != nil {
+		// Whether the unsynced records reached the disk is unknown, and a
+		// retry cannot tell: the OS may have dropped them and report
+		// success.
+		w.failed = fmt.Errorf("failed to sync WAL: %w", err)
+		return w.failed
+	}
+	w.syncedSeq = w.seq
+	return nil
+}
+
+// RecoveryReport returns what NewWAL found while scanning the log.
+func (w *WAL) RecoveryReport() RecoveryReport {
+	return w.report
+}
+
+// LastSeq returns the sequence number of the last record written. It
+// survives truncation: the next record always gets LastSeq()+1.
+func (w *WAL) LastSeq() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+func (w *WAL) segmentPath(n int) string {
+	return fmt.Sprintf("%s.%06d", w.filePath, n)
+}
+
+// listSegments returns the numbers of the existing segment files in order.
+func (w *WAL) listSegments() ([]int, error) {
+	names, err := w.opts.FS.ReadDir(filepath.Dir(w.filePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+	prefix := filepath.Base(w.filePath) + "."
+	var segments []int
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err == nil {
+			segments = append(segments, n)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
 
-	wal := &WAL{file: file, filePath: filePath}
-	wal.seq, _ = wal.getLastSequence()
-	return wal, nil
+// openSegment creates segment n, whose first record will get baseSeq, and
+// makes it the active segment. The directory is synced as well, or a crash
+// could take the segment with every record acknowledged in it.
+func (w *WAL) openSegment(n int, baseSeq int64) error {
+	file, err := w.opts.FS.OpenFile(w.segmentPath(n), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], walMagic)
+	binary.LittleEndian.PutUint16(header[4:], walVersion)
+	binary.LittleEndian.PutUint16(header[6:], uint16(w.opts.Compression.ID()))
+	binary.LittleEndian.PutUint64(header[8:], uint64(baseSeq))
+	if _, err := file.Write(header[:]); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write WAL header: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	if err := w.opts.FS.SyncDir(filepath.Dir(w.filePath)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+	w.file, w.segment, w.size = file, n, walHeaderSize
+	w.codec = w.opts.Compression
+	return nil
 }
 
-func (w *WAL) getLastSequence() (int64, error) {
-	file, err := os.Open(w.filePath)
+// segmentScan is the result of reading one segment.
+type segmentScan struct {
+	codec     Compression
+	ops       []WALOperation
+	lastSeq   int64
+	goodSize  int64 // length of the segment up to the end of the last good record
+	corrupt   int
+	skipped   int64
+	truncated int64
+}
+
+// scanSegment reads every record of segment n, applying the recovery mode to
+// damaged ones. last marks the segment that holds the tail of the log.
+func (w *WAL) scanSegment(n int, last bool) (*segmentScan, error) {
+	path := w.segmentPath(n)
+	data, err := w.opts.FS.ReadFile(path)
 	if err != nil {
-		return 0, err
+		return nil, fmt.Errorf("failed to read WAL segment: %w", err)
+	}
+	if len(data) < walHeaderSize && last && w.opts.Recovery != RecoveryStrict {
+		// We crashed while creating this segment; NewWAL rewrites it.
+		return &segmentScan{truncated: int64(len(data))}, nil
+	}
+	codec, err := segmentCodec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	scan := &segmentScan{codec: codec, lastSeq: int64(binary.LittleEndian.Uint64(data[8:])) - 1}
+	walkRecords(data, codec, func(off, end int, op WALOperation, derr error) bool {
+		if derr == nil {
+			scan.ops = append(scan.ops, op)
+			scan.lastSeq = op.Seq
+			scan.goodSize = int64(end)
+			return true
+		}
+		if end == len(data) && last && w.opts.Recovery != RecoveryStrict {
+			// Nothing valid follows: a torn final write.
+			scan.truncated = int64(len(data) - off)
+			return false
+		}
+		if w.opts.Recovery != RecoverySkipCorrupt {
+			err = fmt.Errorf("%w: %s at offset %d: %v", ErrWALCorrupt, path, off, derr)
+			return false
+		}
+		scan.corrupt++
+		scan.skipped += int64(end - off)
+		scan.goodSize = int64(end)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scan.goodSize == 0 {
+		scan.goodSize = walHeaderSize
+	}
+	return scan, nil
+}
+
+// errBadSegmentHeader is the error for a segment too short to hold a
+// header or not starting with walMagic.
+var errBadSegmentHeader = fmt.Errorf("%w: bad segment header", ErrWALCorrupt)
+
+// segmentCodec checks the header at the start of a segment's data and
+// returns the codec its records are compressed with.
+func segmentCodec(data []byte) (Compression, error) {
+	if len(data) < walHeaderSize || binary.LittleEndian.Uint32(data[0:]) != walMagic {
+		return nil, errBadSegmentHeader
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != walVersion {
+		return nil, fmt.Errorf("unsupported WAL version %d", v)
+	}
+	return compressionByID(byte(binary.LittleEndian.Uint16(data[6:])))
+}
+
+// walkRecords calls fn for every record after the header in a segment's
+// data, with its offset and the offset it ends at, and for every damaged
+// stretch, with the decode error and the offset of the next valid record,
+// or len(data) if none follows. Recovery, replication and the tool all read
+// segments through it, so they agree on where records are. It stops early
+// if fn returns false.
+func walkRecords(data []byte, codec Compression, fn func(off, end int, op WALOperation, err error) bool) {
+	for off := walHeaderSize; off < len(data); {
+		op, size, err := decodeWALRecord(data[off:], codec)
+		end := off + size
+		if err != nil {
+			op = WALOperation{}
+			if end = nextWALRecord(data, off+1, codec); end < 0 {
+				end = len(data)
+			}
+		}
+		if !fn(off, end, op, err) {
+			return
+		}
+		off = end
+	}
+}
+
+// nextWALRecord returns the offset of the first valid record at or after
+// from, or -1 if there is none.
+func nextWALRecord(data []byte, from int, codec Compression) int {
+	for off := from; off+walRecordHeaderSize <= len(data); off++ {
+		if _, _, err := decodeWALRecord(data[off:], codec); err == nil {
+			return off
+		}
+	}
+	return -1
+}
+
+// encodeWALRecord encodes op as one record whose payload is compressed
+// with codec.
+func encodeWALRecord(op WALOperation, codec Compression) ([]byte, error) {
+	var payload []byte
+	if op.Operation == opBatch {
+		payload = append(payload, walOpBatch)
+		payload = binary.AppendUvarint(payload, uint64(len(op.Batch)))
+		for _, sub := range op.Batch {
+			payload = appendWALEntry(payload, sub)
+		}
+	} else {
+		payload = appendWALEntry(payload, op)
+	}
+	payload = binary.AppendVarint(payload, op.Timestamp)
+	payload, err := codec.Compress(payload)
+	if err != nil {
+		return nil, fmt.Errorf("compress WAL record: %w", err)
+	}
+
+	rec := make([]byte, walRecordHeaderSize, walRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(op.Seq))
+	rec = append(rec, payload...)
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[8:]))
+	return rec, nil
+}
+
+// appendWALEntry encodes the op code, key, value and expiry of a PUT or
+// DELETE.
+func appendWALEntry(b []byte, op WALOperation) []byte {
+	code := walOpPut
+	switch {
+	case op.Operation == opDelete:
+		code = walOpDelete
+	case op.ExpiresAt != 0:
+		code = walOpPutTTL
+	}
+	b = append(b, code)
+	b = appendBytes(b, []byte(op.Key))
+	b = appendBytes(b, []byte(op.Value))
+	if code == walOpPutTTL {
+		b = binary.AppendVarint(b, op.ExpiresAt)
+	}
+	return b
+}
+
+// decodeWALRecord decodes the record at the start of b, whose payload is
+// compressed with codec, and returns it with its encoded size.
+func decodeWALRecord(b []byte, codec Compression) (WALOperation, int, error) {
+	if len(b) < walRecordHeaderSize {
+		return WALOperation{}, 0, errWALTorn
+	}
+	length := int(binary.LittleEndian.Uint32(b[0:]))
+	size := walRecordHeaderSize + length
+	if length > len(b)-walRecordHeaderSize {
+		return WALOperation{}, 0, errWALTorn
+	}
+	if crc32.ChecksumIEEE(b[8:size]) != binary.LittleEndian.Uint32(b[4:]) {
+		return WALOperation{}, 0, errors.New("checksum mismatch")
+	}
+
+	payload, err := codec.Decompress(b[walRecordHeaderSize:size])
+	if err != nil {
+		return WALOperation{}, 0, fmt.Errorf("decompress payload: %w", err)
+	}
+	if len(payload) == 0 {
+		return WALOperation{}, 0, errors.New("empty payload")
 	}
-	defer file.Close()
 
-	var lastSeq int64
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var op WALOperation
-		if err := json.Unmarshal(scanner.Bytes(), &op); err == nil {
-			if op.Seq > lastSeq {
-				lastSeq = op.Seq
+	r := &byteReader{data: payload}
+	var op WALOperation
+	if payload[0] == walOpBatch {
+		r.data = r.data[1:]
+		count := r.uvarint()
+		if count > uint64(len(r.data)) {
+			return WALOperation{}, 0, errors.New("bad batch count")
+		}
+		op.Operation = opBatch
+		op.Batch = make([]WALOperation, 0, count)
+		for i := uint64(0); i < count; i++ {
+			sub, err := readWALEntry(r)
+			if err != nil {
+				return WALOperation{}, 0, err
 			}
+			op.Batch = append(op.Batch, sub)
+		}
+	} else {
+		if op, err = readWALEntry(r); err != nil {
+			return WALOperation{}, 0, err
+		}
+	}
+
+	ts, n := binary.Varint(r.data)
+	if r.err != nil || n <= 0 || n != len(r.data) {
+		return WALOperation{}, 0, errors.New("bad payload")
+	}
+	op.Seq = int64(binary.LittleEndian.Uint64(b[8:]))
+	op.Timestamp = ts
+	for i := range op.Batch {
+		op.Batch[i].Seq, op.Batch[i].Timestamp = op.Seq, ts
+	}
+	return op, size, nil
+}
+
+// readWALEntry decodes an entry written by appendWALEntry.
+func readWALEntry(r *byteReader) (WALOperation, error) {
+	if len(r.data) == 0 {
+		return WALOperation{}, errors.New("bad payload")
+	}
+	var op WALOperation
+	code := r.data[0]
+	switch code {
+	case walOpPut, walOpPutTTL:
+		op.Operation = opPut
+	case walOpDelete:
+		op.Operation = opDelete
+	default:
+		return WALOperation{}, fmt.Errorf("unknown op %d", code)
+	}
+	r.data = r.data[1:]
+	op.Key = string(r.bytes())
+	op.Value = string(r.bytes())
+	if code == walOpPutTTL && r.err == nil {
+		n := 0
+		if op.ExpiresAt, n = binary.Varint(r.data); n <= 0 {
+			return WALOperation{}, errors.New("bad expiry")
+		}
+		r.data = r.data[n:]
+	}
+	return op, r.err
+}
+
+// waitDurable blocks until the record with sequence number seq is on stable
+// storage if the sync policy promises that before a write returns and
+// append has not already taken care of it.
+func (w *WAL) waitDurable(seq int64) error {
+	if w.opts.Sync != SyncGroupCommit {
+		return nil
+	}
+	return w.groupSync(seq)
+}
+
+// groupSync waits until seq is durable. One writer at a time becomes the
+// leader and fsyncs everything appended so far; the fsync runs without w.mu
+// held, so other writers keep appending and are covered by the next one.
+func (w *WAL) groupSync(seq int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	if w.syncedSeq >= seq {
+		w.mu.Unlock()
+		return nil
+	}
+	file, segment, target := w.file, w.segment, w.seq
+	w.mu.Unlock()
+
+	err := file.Sync()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if w.segment != segment {
+			// The segment was rotated (and synced) while we were at it.
+			return nil
+		}
+		if w.failed == nil {
+			w.failed = fmt.Errorf("failed to sync WAL: %w", err)
 		}
+		return w.failed
 	}
+	w.syncedSeq = max(w.syncedSeq, target)
+	return nil
+}
 
-	return lastSeq, nil
+// append writes op to the active segment as one record and returns its
+// sequence number. Under SyncEveryWrite the record is fsynced before
+// returning.
+func (w *WAL) append(op WALOperation) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	op.Seq, op.Timestamp = w.seq+1, time.Now().UnixNano()
+	if err := w.writeLocked(op); err != nil {
+		return 0, err
+	}
+	return w.seq, nil
 }
 
-func (w *WAL) Log(operation, key, value string) error {
+// appendAt writes op under the sequence number and timestamp it already
+// carries, which must be above every record written so far. Followers use
+// it to log records exactly as the leader numbered them.
+func (w *WAL) appendAt(op WALOperation) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	w.seq++
-	op := WALOperation{
-		Seq:       w.seq,
-		Operation: operation,
-		Key:       key,
-		Value:     value,
-		Timestamp: time.Now().UnixNano(),
+	if op.Seq <= w.seq {
+		return fmt.Errorf("WAL record %d is not after %d", op.Seq, w.seq)
 	}
+	return w.writeLocked(op)
+}
 
-	data, err := json.Marshal(op)
+// writeLocked writes op, which carries its sequence number, as the next
+// record, then syncs or rotates as the options say. Callers hold w.mu.
+func (w *WAL) writeLocked(op WALOperation) error {
+	if w.failed != nil {
+		return w.failed
+	}
+	rec, err := encodeWALRecord(op, w.codec)
 	if err != nil {
-		return fmt.Errorf("failed to marshal WAL operation: %w", err)
+		return err
 	}
 
-	if _, err := w.file.Write(append(data, '\n')); err != nil {
-		return fmt.Errorf("failed to write to WAL: %w", err)
+	if _, err := w.file.Write(rec); err != nil {
+		err = fmt.Errorf("failed to write to WAL: %w", err)
+		// Recovery would stop at the partial record and never see the
+		// records written after it, so it has to go.
+		if w.file.Truncate(w.size) != nil {
+			w.failed = err
+		} else if _, serr := w.file.Seek(w.size, 0); serr != nil {
+			w.failed = err
+		}
+		return err
 	}
-	if err := w.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync WAL: %w", err)
+	w.seq = op.Seq
+	w.size += int64(len(rec))
+	if w.opts.Sync == SyncEveryWrite {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+
+	if w.size >= w.opts.SegmentSize {
+		return w.rotate()
 	}
 	return nil
 }
 
+// rotate syncs and closes the active segment and starts the next one.
+// Callers hold w.mu.
+func (w *WAL) rotate() error {
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		w.failed = fmt.Errorf("failed to close WAL segment: %w", err)
+		return w.failed
+	}
+	if err := w.openSegment(w.segment+1, w.seq+1); err != nil {
+		// The old segment is closed and there is no new one to write to.
+		w.failed = err
+		return err
+	}
+	return nil
+}
+
+// Recover reads every valid record from the WAL in order. Damaged records
+// are skipped; NewWAL has already decided, according to the recovery mode,
+// whether they are acceptable.
 func (w *WAL) Recover() ([]WALOperation, error) {
-	file, err := os.Open(w.filePath)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments, err := w.listSegments()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to open WAL for recovery: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
 	var operations []WALOperation
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var op WALOperation
-		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+	for _, n := range segments {
+		data, err := w.opts.FS.ReadFile(w.segmentPath(n))
+		if err != nil {
+			return nil, fmt.Errorf("error reading WAL: %w", err)
+		}
+		if len(data) < walHeaderSize {
 			continue
 		}
-		operations = append(operations, op)
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading WAL: %w", err)
+		codec, err := segmentCodec(data)
+		if err != nil {
+			return nil, fmt.Errorf("WAL segment %d: %w", n, err)
+		}
+		walkRecords(data, codec, func(_, _ int, op WALOperation, err error) bool {
+			if err == nil {
+				operations = append(operations, op)
+			}
+			return true
+		})
 	}
 	return operations, nil
 }
 
+// Since returns the records with a sequence number above after, in order.
+// complete is false if records right after after may be missing because
+// the segments holding them have already been removed, or were never
+// written because the log jumped ahead with rotateTo.
+//
+// Segment headers hold the sequence number each segment starts at, so only
+// the segment covering after+1 and the ones following it are read.
+func (w *WAL) Since(after int64) (ops []WALOperation, complete bool, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if after >= w.seq {
+		return nil, true, nil
+	}
+	segments, err := w.listSegments()
+	if err != nil {
+		return nil, false, err
+	}
+	i := sort.Search(len(segments), func(i int) bool {
+		base, berr := w.segmentBase(segments[i])
+		if berr != nil && err == nil {
+			err = berr
+		}
+		return berr != nil || base > after+1
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if i == 0 {
+		// Even the oldest segment starts past after+1.
+		return nil, false, nil
+	}
+
+	next := after + 1 // the first sequence number not yet seen
+	for _, n := range segments[i-1:] {
+		data, err := w.opts.FS.ReadFile(w.segmentPath(n))
+		if err != nil {
+			return nil, false, fmt.Errorf("error reading WAL: %w", err)
+		}
+		if len(data) < walHeaderSize {
+			continue
+		}
+		if int64(binary.LittleEndian.Uint64(data[8:])) > next {
+			return ops, false, nil
+		}
+		codec, err := segmentCodec(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("WAL segment %d: %w", n, err)
+		}
+		walkRecords(data, codec, func(_, _ int, op WALOperation, err error) bool {
+			if err != nil {
+				return true
+			}
+			if op.Seq > after {
+				ops = append(ops, op)
+			}
+			next = max(next, op.Seq+1)
+			return true
+		})
+	}
+	return ops, true, nil
+}
+
+// segmentBase returns the sequence number segment n starts at, read from
+// its header alone.
+func (w *WAL) segmentBase(n int) (int64, error) {
+	f, err := w.opts.FS.OpenFile(w.segmentPath(n), os.O_RDONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error reading WAL: %w", err)
+	}
+	defer f.Close()
+	var header [walHeaderSize]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil || binary.LittleEndian.Uint32(header[0:]) != walMagic {
+		return 0, fmt.Errorf("%w: %s: bad segment header", ErrWALCorrupt, w.segmentPath(n))
+	}
+	return int64(binary.LittleEndian.Uint64(header[8:])), nil
+}
+
+// Close syncs any buffered records and closes the active segment.
 func (w *WAL) Close() error {
+	if w.stopSync != nil {
+		close(w.stopSync)
+		w.syncDone.Wait()
+		w.stopSync = nil
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	if w.file != nil {
+		if w.syncedSeq < w.seq {
+			if err := w.syncLocked(); err != nil {
+				w.file.Close()
+				return err
+			}
+		}
 		return w.file.Close()
 	}
 	return nil
 }
 
-func (w *WAL) Truncate() error {
+// Rotate syncs the active segment and starts a new one, returning its
+// number. Every record written before Rotate lives in an older segment.
+func (w *WAL) Rotate() (int, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.file != nil {
-		if err := w.file.Close(); err != nil {
-			return err
-		}
+	if err := w.rotate(); err != nil {
+		return 0, err
 	}
+	return w.segment, nil
+}
+
+// rotateTo is Rotate for a log that jumps ahead to seq: the new segment's
+// first record gets seq+1, as if every record up to seq had been written.
+// A follower installing a snapshot taken at seq uses it. Since reports the
+// skipped records as missing rather than pretending they are empty.
+func (w *WAL) rotateTo(seq int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	file, err := os.OpenFile(w.filePath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	w.seq = max(w.seq, seq)
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+// RemoveSegmentsBefore deletes every segment numbered below n, once their
+// records are safe elsewhere.
+func (w *WAL) RemoveSegmentsBefore(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	segments, err := w.listSegments()
 	if err != nil {
 		return err
 	}
-	w.file = file
-	w.seq = 0
+	for _, s := range segments {
+		if s < n && s != w.segment {
+			if err := w.opts.FS.Remove(w.segmentPath(s)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// Truncate discards every record in the WAL. A fresh segment is created
+// before the old ones are removed, so the sequence number carries on even
+// if we crash half way.
+func (w *WAL) Truncate() error {
+	n, err := w.Rotate()
+	if err != nil {
+		return err
+	}
+	return w.RemoveSegmentsBefore(n)
+}
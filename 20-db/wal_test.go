@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// walBenchWriters is the number of goroutines per GOMAXPROCS that write
+// concurrently, so group commit has writers to batch.
+const walBenchWriters = 16
+
+// logPut logs a PUT of key the way KDB.apply logs a write: append it, then
+// wait until the sync policy considers it durable.
+func logPut(w *WAL, key, value string) error {
+	seq, err := w.append(WALOperation{Operation: opPut, Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	return w.waitDurable(seq)
+}
+
+// BenchmarkWALLog measures WAL write throughput under each sync policy with
+// concurrent writers. Run it with `go test -bench WALLog ./20-db`.
+func BenchmarkWALLog(b *testing.B) {
+	policies := []WALOptions{
+		{Sync: SyncEveryWrite},
+		{Sync: SyncGroupCommit},
+		{Sync: SyncInterval, SyncInterval: 10 * time.Millisecond},
+		{Sync: SyncNone},
+	}
+	for _, opts := range policies {
+		b.Run(opts.Sync.String(), func(b *testing.B) {
+			wal, err := NewWAL(filepath.Join(b.TempDir(), "bench.wal"), opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer wal.Close()
+
+			var n atomic.Int64
+			value := string(make([]byte, 100))
+			b.SetParallelism(walBenchWriters)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := fmt.Sprintf("key-%d", n.Add(1))
+					if err := logPut(wal, key, value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestWALSince reads the log from every position of a WAL of many small
+// segments, some already removed, and across a jump made by rotateTo.
+func TestWALSince(t *testing.T) {
+	wal, err := NewWAL(filepath.Join(t.TempDir(), "since.wal"), WALOptions{SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for i := 0; i < 200; i++ {
+		if err := logPut(wal, fmt.Sprintf("key%03d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := wal.listSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.RemoveSegmentsBefore(segments[len(segments)/2]); err != nil {
+		t.Fatal(err)
+	}
+	first, err := wal.segmentBase(segments[len(segments)/2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(after int64, wantComplete bool, wantFirst, wantLast int64) {
+		t.Helper()
+		ops, complete, err := wal.Since(after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete != wantComplete {
+			t.Fatalf("Since(%d): complete %v, want %v", after, complete, wantComplete)
+		}
+		if !complete {
+			return
+		}
+		if int64(len(ops)) != wantLast-wantFirst+1 {
+			t.Fatalf("Since(%d): %d records, want %d", after, len(ops), wantLast-wantFirst+1)
+		}
+		for i, op := range ops {
+			if op.Seq != wantFirst+int64(i) {
+				t.Fatalf("Since(%d): record %d has seq %d", after, i, op.Seq)
+			}
+		}
+	}
+	for after := int64(0); after <= 200; after++ {
+		check(after, after >= first-1, after+1, 200)
+	}
+
+	// Records 201-250 were never written here; only reading past them is
+	// complete.
+	if _, err := wal.rotateTo(250); err != nil {
+		t.Fatal(err)
+	}
+	if err := logPut(wal, "after", "jump"); err != nil {
+		t.Fatal(err)
+	}
+	check(199, false, 0, 0)
+	check(200, false, 0, 0)
+	check(250, true, 251, 251)
+}
+
+// TestWALRecoveryModes opens a WAL with a torn final record and one with a
+// corrupt record in the middle under every recovery mode, checking which
+// modes refuse it and what the RecoveryReport counts for the others.
+func TestWALRecoveryModes(t *testing.T) {
+	const records = 10
+	// damage writes a one-segment WAL, hands its data and the offset of
+	// every record to fn and writes back what fn returns. It returns the
+	// path to open the WAL at.
+	damage := func(t *testing.T, fn func(data []byte, offs []int64) []byte) string {
+		path := filepath.Join(t.TempDir(), "test.wal")
+		wal, err := NewWAL(path, WALOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offs []int64
+		for i := 0; i < records; i++ {
+			offs = append(offs, wal.size)
+			if err := logPut(wal, fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		offs = append(offs, wal.size)
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+		segment := wal.segmentPath(1)
+		data, err := os.ReadFile(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(segment, fn(data, offs), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	torn := func(data []byte, offs []int64) []byte {
+		return data[:offs[records-1]+3]
+	}
+	corrupt := func(data []byte, offs []int64) []byte {
+		data[offs[5]+walRecordHeaderSize] ^= 0xff
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		damage  func(data []byte, offs []int64) []byte
+		mode    RecoveryMode
+		refused bool
+		want    func(offs []int64) RecoveryReport
+	}{
+		{name: "torn tail", damage: torn, mode: RecoveryStrict, refused: true},
+		{name: "torn tail", damage: torn, mode: RecoveryTolerateTail,
+			want: func([]int64) RecoveryReport {
+				return RecoveryReport{Segments: 1, Records: records - 1, TruncatedBytes: 3}
+			}},
+		{name: "torn tail", damage: torn, mode: RecoverySkipCorrupt,
+			want: func([]int64) RecoveryReport {
+				return RecoveryReport{Segments: 1, Records: records - 1, TruncatedBytes: 3}
+			}},
+		{name: "corrupt record", damage: corrupt, mode: RecoveryStrict, refused: true},
+		{name: "corrupt record", damage: corrupt, mode: RecoveryTolerateTail, refused: true},
+		{name: "corrupt record", damage: corrupt, mode: RecoverySkipCorrupt,
+			want: func(offs []int64) RecoveryReport {
+				return RecoveryReport{Segments: 1, Records: records - 1, CorruptRecords: 1, SkippedBytes: offs[6] - offs[5]}
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.mode.String(), func(t *testing.T) {
+			var offs []int64
+			path := damage(t, func(data []byte, o []int64) []byte {
+				offs = o
+				return tt.damage(data, o)
+			})
+			wal, err := NewWAL(path, WALOptions{Recovery: tt.mode})
+			if tt.refused {
+				if !errors.Is(err, ErrWALCorrupt) {
+					t.Fatalf("opened with %v, want ErrWALCorrupt", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			if got, want := wal.RecoveryReport(), tt.want(offs); got != want {
+				t.Fatalf("report %+v, want %+v", got, want)
+			}
+			ops, err := wal.Recover()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != records-1 {
+				t.Fatalf("recovered %d records, want %d", len(ops), records-1)
+			}
+			// The log goes on after what was recovered.
+			if err := logPut(wal, "after", "value"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}